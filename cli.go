@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"viveSyncBroker/inspect"
+	"viveSyncBroker/persistence"
+)
+
+// subcommands maps the names of the offline subcommands to their implementation.
+var subcommands = map[string]func(args []string) error{
+	"summary": SummarySubcommand,
+	"filter":  FilterSubcommand,
+	"convert": ConvertSubcommand,
+	"verify":  VerifySubcommand,
+	"decrypt": DecryptSubcommand,
+	"export":  ExportSubcommand,
+	"query":   QuerySubcommand,
+	"e4sim":   E4SimSubcommand,
+}
+
+// runSubcommand executes an offline subcommand and returns the process exit code.
+func runSubcommand(name string, args []string) int {
+	sub, found := subcommands[name]
+	if !found {
+		fmt.Fprintf(os.Stderr, "unknown subcommand '%s'\n", name)
+		usage()
+		return 2
+	}
+	if err := sub(args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// usage prints the available subcommands.
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: unity-broker [serve]
+       unity-broker summary [-gap duration] [filter flags] <file>
+       unity-broker filter [filter flags] <file>
+       unity-broker convert -format jsonl|tables [-out path] [filter flags] <file>
+       unity-broker verify [-manifest file] [-key file] <file or session directory>...
+       unity-broker decrypt [-key file | -passphrase-file file] [-out file] <file>
+       unity-broker query [filter flags] [-where path[=value]]... [-aggregate [-group list] [-value path]
+                          [-format text|jsonl]] <file or folder>...
+       unity-broker export -out folder [-subject id] [-session id] [-task name] [-events list] <file or session directory>
+       unity-broker e4sim [-address host:port] [-devices list] [-replay file] [-comma] [-drop-after duration]
+
+Encrypted files are read with the key or passphrase of PERSIST_ENCRYPTION_KEY_FILE,
+PERSIST_ENCRYPTION_PASSPHRASE_FILE or PERSIST_ENCRYPTION_PASSPHRASE.
+
+The query subcommand reads folders including their session directories, and takes -from and -to
+durations relative to now, e.g. "-from -10m" for the last ten minutes.
+
+Filter flags:
+  -source list    comma separated sources
+  -command list   comma separated commands
+  -from time      RFC 3339 timestamp or duration relative to the start of the recording
+  -to time        RFC 3339 timestamp or duration relative to the start of the recording
+`)
+}
+
+// entryFilter registers the filter flags on a FlagSet.
+type entryFilter struct {
+	sources  *string
+	commands *string
+	from     *string
+	to       *string
+}
+
+// newEntryFilter adds the filter flags to a FlagSet.
+func newEntryFilter(fs *flag.FlagSet) *entryFilter {
+	return &entryFilter{
+		sources:  fs.String("source", "", "comma separated sources"),
+		commands: fs.String("command", "", "comma separated commands"),
+		from:     fs.String("from", "", "start of the time range"),
+		to:       fs.String("to", "", "end of the time range"),
+	}
+}
+
+// load reads the persistence file given as only positional argument and applies the filter flags.
+func (ef *entryFilter) load(fs *flag.FlagSet) ([]inspect.Entry, error) {
+	if fs.NArg() != 1 {
+		usage()
+		return nil, fmt.Errorf("expected exactly one file")
+	}
+	records, err := persistence.ReadFile(fs.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	entries := inspect.Parse(records)
+	var start time.Time
+	for _, e := range entries {
+		if !e.Timestamp.IsZero() && (start.IsZero() || e.Timestamp.Before(start)) {
+			start = e.Timestamp
+		}
+	}
+	filter := inspect.Filter{
+		Sources:  splitList(*ef.sources),
+		Commands: splitList(*ef.commands),
+	}
+	if filter.From, err = inspect.ParseTime(*ef.from, start); err != nil {
+		return nil, err
+	}
+	if filter.To, err = inspect.ParseTime(*ef.to, start); err != nil {
+		return nil, err
+	}
+	return filter.Apply(entries), nil
+}
+
+// SummarySubcommand prints a summary of a persistence file.
+func SummarySubcommand(args []string) error {
+	fs := flag.NewFlagSet("summary", flag.ContinueOnError)
+	gap := fs.Duration("gap", time.Second, "report periods without entries longer than this")
+	ef := newEntryFilter(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	entries, err := ef.load(fs)
+	if err != nil {
+		return err
+	}
+	inspect.Summarize(entries, *gap).Print(os.Stdout)
+	return nil
+}
+
+// FilterSubcommand writes the filtered entries of a persistence file in the persistence file format to stdout.
+func FilterSubcommand(args []string) error {
+	fs := flag.NewFlagSet("filter", flag.ContinueOnError)
+	ef := newEntryFilter(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	entries, err := ef.load(fs)
+	if err != nil {
+		return err
+	}
+	return inspect.WriteCSV(os.Stdout, entries)
+}
+
+// ConvertSubcommand converts a persistence file to JSON Lines or to one CSV table per command.
+func ConvertSubcommand(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "output format: jsonl or tables")
+	out := fs.String("out", "", "output file (jsonl, default stdout) or folder (tables)")
+	ef := newEntryFilter(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	entries, err := ef.load(fs)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "jsonl":
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return inspect.WriteJSONL(w, entries)
+	case "tables":
+		if *out == "" {
+			return fmt.Errorf("tables require an output folder (-out)")
+		}
+		files, err := inspect.WriteTables(*out, entries)
+		for _, file := range files {
+			fmt.Println(file)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown format '%s'", *format)
+	}
+}
+
+// VerifySubcommand checks the hash chains of persistence files for gaps and modifications. For session directories,
+// or if a manifest is given, the files are also checked against the manifest and its signature.
+func VerifySubcommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	manifestFile := fs.String("manifest", "", "session manifest, default the manifest next to the files")
+	keyFile := fs.String("key", "", "public key to check the manifest signature, default the key in the manifest")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		usage()
+		return fmt.Errorf("expected at least one file")
+	}
+	var files []string
+	directory := false
+	for _, arg := range fs.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		directory = true
+		entries, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := filepath.Join(arg, entry.Name())
+			if !entry.IsDir() && persistence.IsPersistenceFile(name) {
+				files = append(files, name)
+			}
+		}
+		if *manifestFile == "" {
+			*manifestFile = persistence.ManifestPath(arg)
+		}
+	}
+	if *manifestFile == "" {
+		*manifestFile = persistence.ManifestPath(filepath.Dir(files[0]))
+	}
+	var manifest *persistence.Session
+	failed := false
+	if *manifestFile != "" {
+		var err error
+		if manifest, err = persistence.ReadManifest(*manifestFile); err != nil {
+			return err
+		}
+		var key ed25519.PublicKey
+		if *keyFile != "" {
+			if key, err = persistence.LoadPublicKey(*keyFile); err != nil {
+				return err
+			}
+		}
+		if manifest.Signature == "" {
+			fmt.Printf("OK   %s: not signed\n", *manifestFile)
+		} else if err = manifest.VerifySignature(key); err != nil {
+			fmt.Printf("FAIL %s: %v\n", *manifestFile, err)
+			failed = true
+		} else if key == nil {
+			fmt.Printf("OK   %s: signature valid for the key in the manifest\n", *manifestFile)
+		} else {
+			fmt.Printf("OK   %s: signature valid\n", *manifestFile)
+		}
+	}
+	found := make(map[string]bool)
+	for _, file := range files {
+		v, err := persistence.VerifyFile(file)
+		if err != nil {
+			v.Problems = append(v.Problems, err.Error())
+		}
+		if manifest != nil {
+			seg, ok := manifest.Segment(file)
+			if !ok {
+				v.Problems = append(v.Problems, "not listed in the manifest")
+			} else {
+				found[seg.File] = true
+				if seg.Records != v.Records || seg.FinalHash != v.FinalHash {
+					v.Problems = append(v.Problems, fmt.Sprintf(
+						"manifest lists %d records with final hash %s", seg.Records, seg.FinalHash,
+					))
+				}
+			}
+		}
+		if len(v.Problems) > 0 {
+			failed = true
+			fmt.Printf("FAIL %s\n", file)
+			for _, problem := range v.Problems {
+				fmt.Printf("     %s\n", problem)
+			}
+			continue
+		}
+		if v.Records == 0 {
+			fmt.Printf("OK   %s: no records\n", file)
+			continue
+		}
+		fmt.Printf("OK   %s: %d records, seq %d-%d, final hash %s\n", file, v.Records, v.FirstSeq, v.LastSeq, v.FinalHash)
+	}
+	if manifest != nil && directory {
+		for _, seg := range manifest.Segments {
+			if !found[seg.File] {
+				failed = true
+				fmt.Printf("FAIL %s: missing\n", seg.File)
+			}
+		}
+	}
+	if failed {
+		return fmt.Errorf("verification failed")
+	}
+	return nil
+}
+
+// DecryptSubcommand decrypts an encrypted persistence file. The output defaults to the file name without the
+// encryption extension.
+func DecryptSubcommand(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "key file")
+	passphraseFile := fs.String("passphrase-file", "", "file holding the passphrase")
+	out := fs.String("out", "", "output file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		usage()
+		return fmt.Errorf("expected exactly one file")
+	}
+	if *keyFile != "" || *passphraseFile != "" {
+		passphrase := ""
+		if *passphraseFile != "" {
+			data, err := ioutil.ReadFile(*passphraseFile)
+			if err != nil {
+				return err
+			}
+			passphrase = strings.TrimRight(string(data), "\r\n")
+		}
+		if err := persistence.SetDecryption(*keyFile, passphrase); err != nil {
+			return err
+		}
+	}
+	src := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(src, ".enc")
+		if *out == src {
+			return fmt.Errorf("'%s' has no .enc extension, use -out", src)
+		}
+	}
+	r, err := persistence.OpenFile(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == persistence.ErrTruncated {
+		fmt.Fprintf(os.Stderr, "Warning: %v, the last records may be missing or incomplete\n", err)
+		err = nil
+	} else if err == nil && persistence.Recovered(r) {
+		fmt.Fprintf(os.Stderr, "Warning: '%s' was truncated by a crash and sealed on recovery, the last records may be "+
+			"missing\n", src)
+	}
+	if err != nil {
+		_ = os.Remove(*out)
+		return err
+	}
+	fmt.Println(*out)
+	return nil
+}
+
+// ExportSubcommand exports a recorded session as BIDS-style dataset. Subject and session default to the participant
+// and start time of the session manifest.
+func ExportSubcommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("out", "", "dataset folder, shared by all exported sessions")
+	subject := fs.String("subject", "", "subject label, default the participant of the session")
+	session := fs.String("session", "", "session label, default the start time of the session")
+	task := fs.String("task", "vr", "task label")
+	events := fs.String("events", "msg,marker", "comma separated commands written to the events file")
+	dataset := fs.String("dataset", "", "dataset name, default the name of the dataset folder")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		usage()
+		return fmt.Errorf("expected exactly one file or session directory")
+	}
+	if *out == "" {
+		return fmt.Errorf("export requires an output folder (-out)")
+	}
+	entries, manifest, err := inspect.LoadSession(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	opts := inspect.BIDSOptions{
+		Dataset:   *dataset,
+		Subject:   *subject,
+		Session:   *session,
+		Task:      *task,
+		Events:    splitList(*events),
+		Generator: "unity-broker",
+		Version:   Version,
+	}
+	if manifest != nil {
+		opts.Reference = manifest.Start
+		if opts.Subject == "" {
+			opts.Subject = manifest.Participant
+		}
+		if opts.Session == "" {
+			opts.Session = manifest.Start.Format("20060102T150405")
+		}
+	}
+	if opts.Subject == "" {
+		return fmt.Errorf("no session manifest, the subject label is required (-subject)")
+	}
+	files, err := inspect.ExportBIDS(*out, entries, opts)
+	for _, file := range files {
+		fmt.Println(file)
+	}
+	return err
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
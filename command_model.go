@@ -5,20 +5,36 @@ import (
 	"fmt"
 	"net"
 	"time"
+	"viveSyncBroker/persistence"
 )
 
 // Command represents a generic command. Each command is described by a command name, timestamp and a command-name
-// specific payload. Also, each Command includes the source client's address.
+// specific payload. Also, each Command includes the source client's address and the time the broker received it.
 type Command struct {
 	Source    *net.UDPAddr           `json:"-"`
+	Received  time.Time              `json:"-"`
 	Command   *string                `json:"command"`
 	Timestamp *time.Time             `json:"timestamp"`
 	Payload   map[string]interface{} `json:"payload"`
 }
 
+// NewCommand creates a Command originating from the broker itself, stamped with the current time.
+func NewCommand(name string, payload map[string]interface{}) *Command {
+	now := time.Now()
+	if payload == nil {
+		payload = make(map[string]interface{})
+	}
+	return &Command{
+		Received:  now,
+		Command:   &name,
+		Timestamp: &now,
+		Payload:   payload,
+	}
+}
+
 // ParseCommand unpacks a json string command to a Command.
 func ParseCommand(cmd []byte, source *net.UDPAddr) (*Command, error) {
-	result := &Command{}
+	result := &Command{Received: time.Now()}
 	if err := json.Unmarshal(cmd, result); err != nil {
 		return nil, err
 	}
@@ -49,8 +65,10 @@ func (c *Command) ToBytes() []byte {
 
 // CommandHandler defines a registry and execution regulator for command name handlers.
 type CommandHandler struct {
-	nm       *NetworkMgr
-	handlers map[string]func(*Command, *CommandHandler) error
+	nm        *NetworkMgr
+	handlers  map[string]func(*Command, *CommandHandler) error
+	scoped    map[string]bool
+	observers []func(*Command)
 }
 
 // NewCommandHandler creates a new CommandHandler.
@@ -58,6 +76,7 @@ func NewCommandHandler(nm *NetworkMgr) *CommandHandler {
 	ch := &CommandHandler{}
 	ch.nm = nm
 	ch.handlers = make(map[string]func(*Command, *CommandHandler) error)
+	ch.scoped = make(map[string]bool)
 	return ch
 }
 
@@ -67,6 +86,19 @@ func (ch *CommandHandler) Register(name string, fn func(*Command, *CommandHandle
 	return ch
 }
 
+// RegisterSessionScoped adds a handler for a command name, which is only accepted while a session is running if
+// SessionRequired is set.
+func (ch *CommandHandler) RegisterSessionScoped(name string, fn func(*Command, *CommandHandler) error) *CommandHandler {
+	ch.scoped[name] = true
+	return ch.Register(name, fn)
+}
+
+// Observe adds a function that gets called with every successfully handled Command.
+func (ch *CommandHandler) Observe(fn func(*Command)) *CommandHandler {
+	ch.observers = append(ch.observers, fn)
+	return ch
+}
+
 // Handle executes a Command for a specific command name handler. If no handler for the Command is registered, an error
 // is being returned.
 func (ch *CommandHandler) Handle(command *Command) error {
@@ -74,7 +106,17 @@ func (ch *CommandHandler) Handle(command *Command) error {
 	if !found {
 		return fmt.Errorf("could not find handler for '%s'", *command.Command)
 	}
-	return handler(command, ch)
+	if SessionRequired && ch.scoped[*command.Command] && ch.nm.Persist.Session() == nil {
+		ch.RespondError(command, fmt.Errorf("'%s' requires a running session", *command.Command))
+		return nil
+	}
+	if err := handler(command, ch); err != nil {
+		return err
+	}
+	for _, observer := range ch.observers {
+		observer(command)
+	}
+	return nil
 }
 
 // Broadcast publishes a Command to the PubSubTopicBasic topic.
@@ -82,12 +124,43 @@ func (ch *CommandHandler) Broadcast(com *Command) {
 	ch.nm.Pubsub.Publish(PubSubTopicBasic, com.ToBytes())
 }
 
-// Respond sends a Command to the Command's source.
+// Respond sends a Command to the Command's source. The response is persisted as outbound from "broker" with the
+// client's address as topic.
 func (ch *CommandHandler) Respond(com *Command) {
-	ch.nm.Pubsub.Unicast(com.Source, com.ToBytes())
+	data := com.ToBytes()
+	ch.nm.Pubsub.Unicast(com.Source, data)
+	rec := persistence.Record{
+		Source:    "broker",
+		Command:   *com.Command,
+		Direction: persistence.DirectionOut,
+		Data:      data,
+	}
+	if com.Source != nil {
+		rec.Topic = com.Source.String()
+	}
+	ch.nm.Persist.AddRecord(rec)
 }
 
-// Persist adds a Command to the persistence queue.
-func (ch *CommandHandler) Persist(com *Command) {
-	ch.nm.Persist.AddEntry(com.Source.String(), com.ToBytes())
+// RespondError sends an error for a Command back to the Command's source.
+func (ch *CommandHandler) RespondError(com *Command, err error) {
+	com.Payload["error"] = err.Error()
+	ch.Respond(com)
+}
+
+// Persist adds a Command published on a topic to the persistence queue. Commands created by the broker itself are
+// persisted as outbound from "broker".
+func (ch *CommandHandler) Persist(com *Command, topic string) {
+	rec := persistence.Record{
+		Time:      com.Received,
+		Source:    "broker",
+		Command:   *com.Command,
+		Topic:     topic,
+		Direction: persistence.DirectionOut,
+		Data:      com.ToBytes(),
+	}
+	if com.Source != nil {
+		rec.Source = com.Source.String()
+		rec.Direction = persistence.DirectionIn
+	}
+	ch.nm.Persist.AddRecord(rec)
 }
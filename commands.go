@@ -2,7 +2,8 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"syscall"
+	"viveSyncBroker/empatica"
 )
 
 // RegisterCommands is the central point to register commands.
@@ -16,11 +17,27 @@ func RegisterCommands() {
 	// Request broker information and general values
 	netmgr.Commands.Register("get", GetCommand)
 	// Set broker information and general values
-	netmgr.Commands.Register("set", SetCommand)
+	netmgr.Commands.RegisterSessionScoped("set", SetCommand)
 	// Set broker information and general values
-	netmgr.Commands.Register("update", UpdateCommand)
+	netmgr.Commands.RegisterSessionScoped("update", UpdateCommand)
 	// Send a message to every listening component
-	netmgr.Commands.Register("msg", MsgCommand)
+	netmgr.Commands.RegisterSessionScoped("msg", MsgCommand)
+	// Mark an event, e.g. a stimulus onset, in all records
+	netmgr.Commands.RegisterSessionScoped("marker", MarkerCommand)
+	// Jump to a phase of the study protocol
+	netmgr.Commands.RegisterSessionScoped("phase", PhaseCommand)
+	// Start a recording session for a participant
+	netmgr.Commands.Register("session_start", SessionStartCommand)
+	// End the running recording session
+	netmgr.Commands.Register("session_end", SessionEndCommand)
+	// Subscribe to additional topics, e.g. forwarded Empatica streams
+	netmgr.Commands.Register("subscribe", SubscribeCommand)
+	// Unsubscribe from additional topics
+	netmgr.Commands.Register("unsubscribe", UnsubscribeCommand)
+	// Change the subscribed Empatica streams
+	netmgr.Commands.Register("e4_streams", E4StreamsCommand)
+	// Control the replay of a recorded session
+	netmgr.Commands.Register("replay", ReplayCommand)
 }
 
 // EchoCommand is the Command for "echo".
@@ -32,14 +49,17 @@ func EchoCommand(com *Command, ch *CommandHandler) error {
 
 // ShutdownCommand is the Command for "shutdown"
 func ShutdownCommand(com *Command, ch *CommandHandler) error {
-	// os.Exit sends a syscall.SIGINT on exit, that gets worked with in the shutdown routine
-	os.Exit(1)
+	// Shut down like on SIGTERM, so pending records are persisted
+	select {
+	case shutdown <- syscall.SIGTERM:
+	default:
+	}
 	return nil
 }
 
 // DisconnectCommand is the Command for "disconnect".
 func DisconnectCommand(com *Command, ch *CommandHandler) error {
-	ch.nm.Pubsub.Unsubscribe(PubSubTopicBasic, com.Source)
+	ch.nm.Pubsub.UnsubscribeAll(com.Source)
 	return nil
 }
 
@@ -61,28 +81,83 @@ func GetCommand(com *Command, ch *CommandHandler) error {
 			com.Payload["response"] = ch.nm.Pubsub.GetClients()
 			ch.Respond(com)
 			break
+		case "condition":
+			if conditions == nil {
+				ch.RespondError(com, fmt.Errorf("no condition table loaded"))
+				break
+			}
+			participant, _ := com.Payload["participant"].(string)
+			assignment, found := conditions.Current()
+			if participant != "" {
+				assignment, found = conditions.Get(participant)
+			}
+			if !found {
+				ch.RespondError(com, fmt.Errorf("no condition assigned"))
+				break
+			}
+			com.Payload["response"] = assignment
+			ch.Respond(com)
+			break
+		case "session":
+			session := ch.nm.Persist.Session()
+			if session == nil {
+				ch.RespondError(com, fmt.Errorf("no session running"))
+				break
+			}
+			com.Payload["response"] = session
+			ch.Respond(com)
+			break
+		case "phase":
+			if studyRunner == nil {
+				ch.RespondError(com, fmt.Errorf("no study protocol loaded"))
+				break
+			}
+			com.Payload["response"] = studyRunner.State()
+			ch.Respond(com)
+			break
+		case "devices":
+			com.Payload["response"] = empatica.Devices()
+			ch.Respond(com)
+			break
+		case "sensors":
+			com.Payload["response"] = Sensors()
+			ch.Respond(com)
+			break
+		case "persistence":
+			com.Payload["response"] = ch.nm.Persist.Metrics()
+			ch.Respond(com)
+			break
 		}
 	}
 	return nil
 }
 
-// SetCommand is the Command for "set"
+// SetCommand is the Command for "set". If the payload contains a "participant", the participant is assigned a
+// condition sequence, which is added to the payload as "assignment".
 func SetCommand(com *Command, ch *CommandHandler) error {
-	ch.Persist(com)
+	if participant, ok := com.Payload["participant"].(string); ok && conditions != nil {
+		assignment, err := assignParticipant(participant)
+		if err != nil {
+			ch.RespondError(com, err)
+			return nil
+		}
+		com.Payload["assignment"] = assignment
+	}
+	ch.Persist(com, PubSubTopicBasic)
 	ch.Broadcast(com)
 	return nil
 }
 
 // UpdateCommand is the Command for "update".
 func UpdateCommand(com *Command, ch *CommandHandler) error {
-	ch.Persist(com)
+	ch.Persist(com, PubSubTopicBasic)
 	ch.Broadcast(com)
 	return nil
 }
 
 // MsgCommand is the Command for "send".
 func MsgCommand(com *Command, ch *CommandHandler) error {
-	ch.Persist(com)
+	ch.Persist(com, PubSubTopicBasic)
 	ch.Broadcast(com)
 	return nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"viveSyncBroker/counterbalance"
+)
+
+var (
+	conditions *counterbalance.Service
+)
+
+// setupCounterbalance creates the condition assignment service. The condition order table is either loaded from
+// COUNTERBALANCE_TABLE or generated as balanced latin square from the comma separated COUNTERBALANCE_CONDITIONS.
+// Assignments are stored in COUNTERBALANCE_FILE.
+func setupCounterbalance() error {
+	var table counterbalance.Table
+	if file := os.Getenv("COUNTERBALANCE_TABLE"); file != "" {
+		t, err := counterbalance.LoadTable(file)
+		if err != nil {
+			return err
+		}
+		table = t
+	} else if list := os.Getenv("COUNTERBALANCE_CONDITIONS"); list != "" {
+		table = counterbalance.LatinSquare(strings.Split(list, ","))
+	} else {
+		return nil
+	}
+	file := os.Getenv("COUNTERBALANCE_FILE")
+	if file == "" {
+		file = "assignments.json"
+	}
+	service, err := counterbalance.NewService(table, file)
+	if err != nil {
+		return err
+	}
+	conditions = service
+	return nil
+}
+
+// assignParticipant assigns a condition sequence to a participant and hands it to the study protocol.
+func assignParticipant(participant string) (counterbalance.Assignment, error) {
+	a, err := conditions.Assign(participant)
+	if err != nil {
+		return a, err
+	}
+	if studyRunner != nil {
+		studyRunner.SetConditions(a.Sequence)
+	}
+	return a, nil
+}
@@ -0,0 +1,148 @@
+package counterbalance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Assignment is the condition sequence assigned to a participant.
+type Assignment struct {
+	Participant string    `json:"participant"`
+	Row         int       `json:"row"`
+	Sequence    []string  `json:"sequence"`
+	Assigned    time.Time `json:"assigned"`
+}
+
+// state is the on-disk representation of a Service.
+type state struct {
+	Table       Table        `json:"table"`
+	Assignments []Assignment `json:"assignments"`
+	Current     string       `json:"current,omitempty"`
+}
+
+// Service assigns condition sequences of a Table to participants in order of arrival. Assignments are stored in a
+// json file after every change, so they survive broker restarts.
+type Service struct {
+	mu          sync.Mutex
+	file        string
+	table       Table
+	assignments []Assignment
+	current     string
+}
+
+// NewService creates a new Service for a Table and restores previous assignments from file. If the file was written
+// for a different table, an error is returned to avoid mixing condition orders within a study.
+func NewService(table Table, file string) (*Service, error) {
+	if len(table) == 0 {
+		return nil, fmt.Errorf("empty condition table")
+	}
+	s := &Service{
+		file:  file,
+		table: table,
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := state{}
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("could not parse assignments '%s': %v", file, err)
+	}
+	if !table.equals(st.Table) {
+		return nil, fmt.Errorf("assignments in '%s' were made for a different condition table", file)
+	}
+	s.assignments = st.Assignments
+	s.current = st.Current
+	return s, nil
+}
+
+// Table returns the condition order table.
+func (s *Service) Table() Table {
+	return s.table
+}
+
+// Assign returns the condition sequence of a participant. Unknown participants get the next row of the table. The
+// participant becomes the current one, which is stored along with the assignments.
+func (s *Service) Assign(participant string) (Assignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if participant == "" {
+		return Assignment{}, fmt.Errorf("missing participant id")
+	}
+	if a, found := s.find(participant); found {
+		if participant != s.current {
+			previous := s.current
+			s.current = participant
+			if err := s.save(); err != nil {
+				s.current = previous
+				return Assignment{}, err
+			}
+		}
+		return a, nil
+	}
+	previous := s.current
+	s.current = participant
+	row := len(s.assignments) % len(s.table)
+	a := Assignment{
+		Participant: participant,
+		Row:         row,
+		Sequence:    s.table[row],
+		Assigned:    time.Now(),
+	}
+	s.assignments = append(s.assignments, a)
+	if err := s.save(); err != nil {
+		s.assignments = s.assignments[:len(s.assignments)-1]
+		s.current = previous
+		return Assignment{}, err
+	}
+	return a, nil
+}
+
+// Get returns the assignment of a participant.
+func (s *Service) Get(participant string) (Assignment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.find(participant)
+}
+
+// Current returns the assignment of the most recently assigned participant, also across restarts.
+func (s *Service) Current() (Assignment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.find(s.current)
+}
+
+// find looks up the assignment of a participant. The caller has to hold the lock.
+func (s *Service) find(participant string) (Assignment, bool) {
+	for _, a := range s.assignments {
+		if a.Participant == participant {
+			return a, true
+		}
+	}
+	return Assignment{}, false
+}
+
+// save writes all assignments to a temporary file and moves it over the assignments file, so a crash never leaves a
+// partially written file behind. The caller has to hold the lock.
+func (s *Service) save() error {
+	data, err := json.MarshalIndent(state{
+		Table:       s.table,
+		Assignments: s.assignments,
+		Current:     s.current,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
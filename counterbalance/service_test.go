@@ -0,0 +1,64 @@
+package counterbalance
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAssign(t *testing.T) {
+	table := LatinSquare([]string{"A", "B", "C", "D"})
+	file := filepath.Join(t.TempDir(), "assignments.json")
+	s, err := NewService(table, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, participant := range []string{"P1", "P2", "P3", "P4", "P5"} {
+		a, err := s.Assign(participant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Row != i%len(table) || a.Participant != participant {
+			t.Errorf("%s: got row %d", participant, a.Row)
+		}
+	}
+	if a, err := s.Assign("P2"); err != nil || a.Row != 1 {
+		t.Errorf("P2 again: got row %d, %v", a.Row, err)
+	}
+	if _, err = s.Assign(""); err == nil {
+		t.Error("assigned a participant without id")
+	}
+
+	// Assignments and the current participant survive a restart
+	s, err = NewService(table, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, found := s.Current(); !found || a.Participant != "P2" {
+		t.Errorf("got current %+v", a)
+	}
+	if a, found := s.Get("P5"); !found || a.Row != 0 {
+		t.Errorf("got P5 %+v", a)
+	}
+	if a, err := s.Assign("P6"); err != nil || a.Row != 1 || a.Sequence[0] != table[1][0] {
+		t.Errorf("P6: got %+v, %v", a, err)
+	}
+	if _, err = NewService(LatinSquare([]string{"A", "B", "C"}), file); err == nil {
+		t.Error("restored assignments of a different table")
+	}
+}
+
+func TestAssignSaveError(t *testing.T) {
+	s, err := NewService(LatinSquare([]string{"A", "B"}), filepath.Join(t.TempDir(), "missing", "assignments.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Assign("P1"); err == nil {
+		t.Fatal("assignment was not saved, but no error returned")
+	}
+	if _, found := s.Current(); found {
+		t.Error("failed assignment became the current one")
+	}
+	if _, found := s.Get("P1"); found {
+		t.Error("failed assignment was kept")
+	}
+}
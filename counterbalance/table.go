@@ -0,0 +1,93 @@
+package counterbalance
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Table is an ordered list of condition sequences. Participants are assigned the rows in turn.
+type Table [][]string
+
+// LatinSquare creates a balanced latin square (Williams design) for a list of conditions. Every condition appears
+// once per position and follows every other condition equally often. For an odd number of conditions, the mirrored
+// rows are appended, resulting in 2n rows.
+func LatinSquare(conditions []string) Table {
+	n := len(conditions)
+	if n == 0 {
+		return nil
+	}
+	// The first row reads 0, 1, n-1, 2, n-2, ..., every following row is shifted by one
+	first := make([]int, n)
+	for i, lo, hi := 1, 1, n-1; i < n; i++ {
+		if i%2 == 1 {
+			first[i] = lo
+			lo++
+		} else {
+			first[i] = hi
+			hi--
+		}
+	}
+	table := make(Table, 0, 2*n)
+	for r := 0; r < n; r++ {
+		row := make([]string, n)
+		for j := 0; j < n; j++ {
+			row[j] = conditions[(first[j]+r)%n]
+		}
+		table = append(table, row)
+	}
+	if n%2 == 1 {
+		for r := 0; r < n; r++ {
+			row := make([]string, n)
+			for j := 0; j < n; j++ {
+				row[j] = table[r][n-1-j]
+			}
+			table = append(table, row)
+		}
+	}
+	return table
+}
+
+// LoadTable reads a custom condition order table from a CSV file with one sequence per row. Both ',' and ';' are
+// accepted as delimiter.
+func LoadTable(path string) (Table, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if strings.Count(string(data), ";") > strings.Count(string(data), ",") {
+		reader.Comma = ';'
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	table := make(Table, 0, len(rows))
+	for _, row := range rows {
+		if len(row) == 0 || (len(row) == 1 && row[0] == "") {
+			continue
+		}
+		table = append(table, row)
+	}
+	if len(table) == 0 {
+		return nil, fmt.Errorf("no condition sequences in '%s'", path)
+	}
+	return table, nil
+}
+
+// equals reports if two tables contain the same sequences.
+func (t Table) equals(o Table) bool {
+	if len(t) != len(o) {
+		return false
+	}
+	for i := range t {
+		if strings.Join(t[i], "\x00") != strings.Join(o[i], "\x00") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package counterbalance
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLatinSquare(t *testing.T) {
+	for n := 2; n <= 7; n++ {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			conditions := make([]string, n)
+			for i := range conditions {
+				conditions[i] = string(rune('A' + i))
+			}
+			table := LatinSquare(conditions)
+			rows := n
+			if n%2 == 1 {
+				rows = 2 * n
+			}
+			if len(table) != rows {
+				t.Fatalf("expected %d rows, got %d", rows, len(table))
+			}
+			// Every half of the rows of an odd square is a latin square of its own
+			repetitions := rows / n
+			columns := make([]map[string]int, n)
+			for i := range columns {
+				columns[i] = make(map[string]int)
+			}
+			carryover := make(map[string]int)
+			for r, row := range table {
+				if len(row) != n {
+					t.Fatalf("row %d has %d conditions", r, len(row))
+				}
+				seen := make(map[string]bool)
+				for j, condition := range row {
+					if seen[condition] {
+						t.Errorf("row %d %v repeats %s", r, row, condition)
+					}
+					seen[condition] = true
+					columns[j][condition]++
+					if j > 0 {
+						carryover[row[j-1]+condition]++
+					}
+				}
+			}
+			for j, counts := range columns {
+				for _, condition := range conditions {
+					if counts[condition] != repetitions {
+						t.Errorf("column %d holds %s %d times", j, condition, counts[condition])
+					}
+				}
+			}
+			// With the mirrored rows of an odd square, every condition precedes every other one twice
+			for _, a := range conditions {
+				for _, b := range conditions {
+					if a != b && carryover[a+b] != repetitions {
+						t.Errorf("%s precedes %s %d times", a, b, carryover[a+b])
+					}
+				}
+			}
+		})
+	}
+	if table := LatinSquare(nil); table != nil {
+		t.Errorf("expected no table without conditions, got %v", table)
+	}
+}
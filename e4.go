@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"viveSyncBroker/empatica"
+	"viveSyncBroker/empatica/metrics"
+	"viveSyncBroker/empatica/simulator"
+	"viveSyncBroker/sensor"
+)
+
+// setupE4Metrics starts deriving metrics like heart rate and SCR counts from the Empatica samples if
+// E4_METRICS_INTERVAL is set, e.g. "1s". The metrics of every device with new samples are persisted and published as
+// "e4_metrics" Command once per interval, on the topic E4_METRICS_TOPIC with the placeholder {device}, default
+// "e4/metrics". It returns the Processor the samples are passed to, or nil.
+func setupE4Metrics(ch *CommandHandler) *metrics.Processor {
+	s := os.Getenv("E4_METRICS_INTERVAL")
+	if s == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval <= 0 {
+		fmt.Printf("invalid E4_METRICS_INTERVAL '%s'\n", s)
+		return nil
+	}
+	topic := os.Getenv("E4_METRICS_TOPIC")
+	if topic == "" {
+		topic = "e4/metrics"
+	}
+	processor := metrics.NewProcessor(metrics.ConfigFromEnv())
+	go func() {
+		for range time.Tick(interval) {
+			for _, m := range processor.Compute() {
+				com := e4MetricsCommand(m)
+				published := strings.Replace(topic, "{device}", m.Device, -1)
+				ch.Persist(com, published)
+				ch.nm.Pubsub.Publish(published, com.ToBytes())
+			}
+		}
+	}()
+	return processor
+}
+
+// e4MetricsCommand creates the "e4_metrics" Command, stamped with the device time of the latest sample.
+func e4MetricsCommand(m metrics.Metrics) *Command {
+	payload := map[string]interface{}{
+		"device": m.Device,
+	}
+	if m.Heart != nil {
+		payload["heart"] = m.Heart
+	}
+	if m.GSR != nil {
+		payload["gsr"] = m.GSR
+	}
+	if m.Movement != nil {
+		payload["movement"] = m.Movement
+	}
+	com := NewCommand("e4_metrics", payload)
+	com.Timestamp = &m.Time
+	return com
+}
+
+// E4StreamsCommand is the Command for "e4_streams". It subscribes the "enable" and unsubscribes the "disable" streams
+// of the payload, e.g. ["bvp"], for the "device" of the payload or all devices, and responds right away with the
+// devices and their new streams. The streaming server is asked in the background.
+func E4StreamsCommand(com *Command, ch *CommandHandler) error {
+	enable := stringList(com.Payload["enable"])
+	disable := stringList(com.Payload["disable"])
+	for _, streams := range [][]string{enable, disable} {
+		if _, err := empatica.ParseStreams(streams); err != nil {
+			ch.RespondError(com, err)
+			return nil
+		}
+	}
+	device, _ := com.Payload["device"].(string)
+	var selected []sensor.Adapter
+	for _, a := range sensors {
+		if a.Kind() == "e4" && (device == "" || a.Name() == device) {
+			selected = append(selected, a)
+		}
+	}
+	if len(selected) == 0 {
+		if device == "" {
+			ch.RespondError(com, fmt.Errorf("no device configured"))
+		} else {
+			ch.RespondError(com, fmt.Errorf("unknown device '%s'", device))
+		}
+		return nil
+	}
+	var first error
+	for _, a := range selected {
+		// Empty lists would select all streams
+		var err error
+		if len(enable) > 0 {
+			err = a.Start(enable)
+		}
+		if len(disable) > 0 {
+			if err2 := a.Stop(disable); err == nil {
+				err = err2
+			}
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("device %s: %w", a.Name(), err)
+		}
+	}
+	if first != nil {
+		ch.RespondError(com, first)
+		return nil
+	}
+	com.Payload["response"] = empatica.Devices()
+	ch.Respond(com)
+	return nil
+}
+
+// SubscribeCommand is the Command for "subscribe". It subscribes the client to the "topics" of the payload, e.g.
+// "e4/gsr", and responds with all topics the client is subscribed to.
+func SubscribeCommand(com *Command, ch *CommandHandler) error {
+	topics := stringList(com.Payload["topics"])
+	if len(topics) == 0 {
+		ch.RespondError(com, fmt.Errorf("missing topics"))
+		return nil
+	}
+	for _, topic := range topics {
+		ch.nm.Pubsub.Subscribe(topic, com.Source)
+	}
+	com.Payload["response"] = ch.nm.Pubsub.Topics(com.Source)
+	ch.Respond(com)
+	return nil
+}
+
+// UnsubscribeCommand is the Command for "unsubscribe". It unsubscribes the client from the "topics" of the payload
+// and responds with the remaining topics. The topic "basic" is kept, use "disconnect" to leave the broker.
+func UnsubscribeCommand(com *Command, ch *CommandHandler) error {
+	for _, topic := range stringList(com.Payload["topics"]) {
+		if topic != PubSubTopicBasic {
+			ch.nm.Pubsub.Unsubscribe(topic, com.Source)
+		}
+	}
+	com.Payload["response"] = ch.nm.Pubsub.Topics(com.Source)
+	ch.Respond(com)
+	return nil
+}
+
+// E4SimSubcommand runs a simulated E4 streaming server with synthetic or recorded signals. Faults are injected by
+// lines on stdin: "disconnect", "lose <device>", "reestablish <device>" and "tag <device>".
+func E4SimSubcommand(args []string) error {
+	fs := flag.NewFlagSet("e4sim", flag.ContinueOnError)
+	address := fs.String("address", "127.0.0.1:28000", "address to listen on")
+	devices := fs.String("devices", "A01B2C", "comma separated device IDs")
+	replayFile := fs.String("replay", "", "persistence file with recorded E4 samples to replay")
+	comma := fs.Bool("comma", false, "write decimals with a comma")
+	dropAfter := fs.Duration("drop-after", 0, "close every client connection after this time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	sim := simulator.New(splitList(*devices)...)
+	sim.CommaDecimals, sim.DropAfter = *comma, *dropAfter
+	if *replayFile != "" {
+		source, err := simulator.LoadReplay(*replayFile)
+		if err != nil {
+			return err
+		}
+		sim.Source = source
+	}
+	if err := sim.Listen(*address); err != nil {
+		return err
+	}
+	fmt.Printf("Simulating E4 streaming server on %s with devices %s\n", sim.Addr(), strings.Join(sim.Devices, ", "))
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		device := ""
+		if len(fields) > 1 {
+			device = fields[1]
+		}
+		switch fields[0] {
+		case "disconnect":
+			sim.Disconnect()
+		case "lose":
+			sim.LoseDevice(device)
+		case "reestablish":
+			sim.ReestablishDevice(device)
+		case "tag":
+			sim.Tag(device)
+		default:
+			fmt.Printf("unknown fault '%s'\n", fields[0])
+		}
+	}
+	// Keep serving when stdin is closed, e.g. when started in the background
+	select {}
+}
@@ -0,0 +1,98 @@
+package empatica
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"viveSyncBroker/sensor"
+)
+
+// Adapter is the sensor of an E4 device. The streaming server handles one device per connection, so every device
+// has its own connection, which is supervised and reconnected when it drops.
+type Adapter struct {
+	sv     *supervisor
+	server *StreamingServer
+}
+
+// NewAdapters is the sensor.Factory of the E4 devices. It connects to the streaming server at E4_SERVER_ADDRESS and
+// E4_SERVER_PORT and creates an adapter for each device given as comma separated IDs in E4_DEVICES, or for the first
+// device of the streaming server. The streams are given as comma separated names in E4_STREAMS, e.g. "gsr,ibi,bvp",
+// or "all". If no device is available yet, the adapter keeps asking the streaming server until one is found.
+func NewAdapters(name string, env func(key string) string) ([]sensor.Adapter, error) {
+	port, err := strconv.Atoi(os.Getenv("E4_SERVER_PORT"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid E4_SERVER_PORT '%s'", os.Getenv("E4_SERVER_PORT"))
+	}
+	streams := DefaultStreams
+	if s := os.Getenv("E4_STREAMS"); s != "" {
+		if streams, err = ParseStreams(splitIDs(s)); err != nil || streams == 0 {
+			fmt.Printf("invalid E4_STREAMS '%s'\n", s)
+			streams = DefaultStreams
+		}
+	}
+	address := os.Getenv("E4_SERVER_ADDRESS")
+	selected := splitIDs(os.Getenv("E4_DEVICES"))
+	server := NewStreamingServer(address, port)
+	server.Timeout = DurationEnv("E4_REQUEST_TIMEOUT", DefaultTimeout)
+	if err = server.Connect(); err != nil {
+		fmt.Printf("Error: %+v\n", err)
+		server = nil
+	} else {
+		available, err := ListDevices(server)
+		if err != nil {
+			fmt.Printf("Error: %+v\n", err)
+		}
+		if len(selected) == 0 && len(available) > 0 {
+			selected = available[:1]
+		}
+	}
+	if len(selected) == 0 {
+		fmt.Println("Error: No Device Available, retrying")
+		return []sensor.Adapter{&Adapter{sv: newSupervisor(address, port, "", streams), server: server}}, nil
+	}
+	adapters := make([]sensor.Adapter, 0, len(selected))
+	for _, id := range selected {
+		// The connection used for the device list serves the first device
+		adapters = append(adapters, &Adapter{sv: newSupervisor(address, port, id, streams), server: server})
+		server = nil
+	}
+	return adapters, nil
+}
+
+func (a *Adapter) Kind() string                  { return "e4" }
+func (a *Adapter) Name() string                  { return a.sv.device() }
+func (a *Adapter) Channels() []string            { return (allStreams | StreamHr).Strings() }
+func (a *Adapter) Samples() <-chan sensor.Sample { return a.sv.samples }
+func (a *Adapter) Status() <-chan sensor.Status  { return a.sv.status }
+func (a *Adapter) Close() error                  { return a.sv.close() }
+
+// Connect starts the supervision of the device.
+func (a *Adapter) Connect() error {
+	go a.sv.run(a.server)
+	a.server = nil
+	return nil
+}
+
+// Start subscribes streams, e.g. "bvp", in the background. The changes are kept when the device is reconnected.
+func (a *Adapter) Start(channels []string) error {
+	streams := allStreams
+	if len(channels) > 0 {
+		var err error
+		if streams, err = ParseStreams(channels); err != nil {
+			return err
+		}
+	}
+	return a.sv.setStreams(streams, 0)
+}
+
+// Stop unsubscribes streams in the background.
+func (a *Adapter) Stop(channels []string) error {
+	streams := allStreams
+	if len(channels) > 0 {
+		var err error
+		if streams, err = ParseStreams(channels); err != nil {
+			return err
+		}
+	}
+	return a.sv.setStreams(0, streams)
+}
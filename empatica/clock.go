@@ -0,0 +1,98 @@
+package empatica
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock estimates the offset between the clock of the streaming server, which timestamps the samples, and the
+// broker's clock. Samples arrive after a varying delay, so the difference between receive time and sample timestamp
+// is the offset plus the delay. The offset is estimated as the smallest difference within a window, which follows a
+// drifting clock. The least delayed sample of each second is kept; the uncertainty is how far the median of these lies
+// above the estimate.
+type Clock struct {
+	window      time.Duration
+	mu          sync.Mutex
+	seconds     []clockSecond
+	offset      time.Duration
+	uncertainty time.Duration
+	known       bool
+}
+
+// clockSecond holds the smallest and largest difference of the samples received within a second.
+type clockSecond struct {
+	second int64
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewClock creates a Clock estimating the offset over a window, e.g. one minute.
+func NewClock(window time.Duration) *Clock {
+	return &Clock{window: window}
+}
+
+// Add updates the estimate with the timestamp of a sample and the time the broker received it.
+func (c *Clock) Add(timestamp time.Time, received time.Time) {
+	diff := received.Sub(timestamp)
+	second := received.Unix()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.seconds); n > 0 && c.seconds[n-1].second == second {
+		if diff < c.seconds[n-1].min {
+			c.seconds[n-1].min = diff
+		}
+		if diff > c.seconds[n-1].max {
+			c.seconds[n-1].max = diff
+		}
+	} else {
+		c.seconds = append(c.seconds, clockSecond{second: second, min: diff, max: diff})
+	}
+	first := 0
+	for first < len(c.seconds)-1 && time.Duration(second-c.seconds[first].second)*time.Second >= c.window {
+		first++
+	}
+	c.seconds = c.seconds[first:]
+	c.estimate()
+}
+
+// estimate computes offset and uncertainty from the seconds within the window. With less than three seconds, the
+// uncertainty is the spread of all differences.
+func (c *Clock) estimate() {
+	minima := make([]time.Duration, len(c.seconds))
+	spread := time.Duration(0)
+	for i, s := range c.seconds {
+		minima[i] = s.min
+		if s.max > spread {
+			spread = s.max
+		}
+	}
+	sort.Slice(minima, func(i, j int) bool {
+		return minima[i] < minima[j]
+	})
+	c.offset = minima[0]
+	c.known = true
+	if len(minima) < 3 {
+		c.uncertainty = spread - c.offset
+		return
+	}
+	c.uncertainty = minima[len(minima)/2] - c.offset
+}
+
+// Offset returns the estimated offset of the broker's clock from the streaming server's clock and its uncertainty.
+// It reports false until a sample was added.
+func (c *Clock) Offset() (time.Duration, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset, c.uncertainty, c.known
+}
+
+// Align sets the aligned timestamp of a sample and its uncertainty.
+func (c *Clock) Align(ds *StreamingData) {
+	offset, uncertainty, known := c.Offset()
+	if !known {
+		return
+	}
+	ds.Aligned = ds.Timestamp.Add(offset)
+	ds.Uncertainty = uncertainty.Seconds()
+}
@@ -0,0 +1,39 @@
+package empatica
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	clock := NewClock(10 * time.Second)
+	if _, _, known := clock.Offset(); known {
+		t.Fatal("offset known without samples")
+	}
+	random := rand.New(rand.NewSource(1))
+	device := time.Unix(1700000000, 0)
+	offset := 2 * time.Second
+	for i := 0; i < 4*30; i++ {
+		device = device.Add(time.Second / 4)
+		// The streaming server sends some samples in batches with up to 300 ms delay
+		delay := 5*time.Millisecond + time.Duration(random.Intn(300))*time.Millisecond
+		clock.Add(device, device.Add(offset+delay))
+		if i == 4*20 {
+			// The server's clock is set back by 1 second
+			offset += time.Second
+		}
+	}
+	estimate, uncertainty, known := clock.Offset()
+	if !known || estimate < offset || estimate > offset+20*time.Millisecond {
+		t.Errorf("got offset %s, want %s", estimate, offset)
+	}
+	if uncertainty <= 0 || uncertainty > 100*time.Millisecond {
+		t.Errorf("got uncertainty %s", uncertainty)
+	}
+	ds := StreamingData{Timestamp: device}
+	clock.Align(&ds)
+	if !ds.Time().Equal(device.Add(estimate)) || ds.Uncertainty != uncertainty.Seconds() {
+		t.Errorf("got aligned %s ± %f", ds.Time(), ds.Uncertainty)
+	}
+}
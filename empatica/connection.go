@@ -1,69 +1,145 @@
 package empatica
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"sort"
 	"strconv"
-	"viveSyncBroker/persistence"
+	"strings"
+	"sync"
 )
 
+// DeviceInfo describes an E4 device known to the streaming server.
+type DeviceInfo struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	Connected bool     `json:"connected"`
+	Status    string   `json:"status,omitempty"`
+	Streams   []string `json:"streams,omitempty"`
+	// ClockOffset is the time in seconds the broker's clock is ahead of the streaming server's clock.
+	ClockOffset      float64 `json:"clock_offset,omitempty"`
+	ClockUncertainty float64 `json:"clock_uncertainty,omitempty"`
+}
+
+// DefaultStreams are subscribed if E4_STREAMS is not set. The battery stream is needed for low battery warnings, the
+// tag stream for the markers set with the button of a device.
+const DefaultStreams = StreamGsr | StreamIbi | StreamTmp | StreamBat | StreamTag
+
 var (
-	device string
+	devicesMu sync.Mutex
+	devices   = make(map[string]*DeviceInfo)
 )
 
-func Setup(ph *persistence.PersistenceHandler) {
-	port, err := strconv.Atoi(os.Getenv("E4_SERVER_PORT"))
-	if err != nil {
-		fmt.Printf("Error: %+v\n", err)
+// Devices returns the devices listed by the streaming server and the configured ones, ordered by ID.
+func Devices() []DeviceInfo {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	result := make([]DeviceInfo, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, *d)
 	}
-	server := NewStreamingServer(os.Getenv("E4_SERVER_ADDRESS"), port)
-	err = server.Connect()
-	if err != nil {
-		fmt.Printf("Error: %+v\n", err)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// updateDevice changes the registry entry of a device.
+func updateDevice(id string, update func(d *DeviceInfo)) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	d, found := devices[id]
+	if !found {
+		d = &DeviceInfo{ID: id}
+		devices[id] = d
 	}
-	err = ConnectToFirstE4(server)
+	update(d)
+}
+
+// ConnectE4 connects a device on a streaming server connection and subscribes the given streams. Streams the
+// streaming server refuses are reported, but do not fail the connection.
+func ConnectE4(server *StreamingServer, id string, streams StreamType) error {
+	updateDevice(id, func(d *DeviceInfo) {})
+	if err := server.ConnectDevice(id); err != nil {
+		return fmt.Errorf("failed to connect to device %s: %w", id, err)
+	}
+	updateDevice(id, func(d *DeviceInfo) {
+		d.Connected = true
+	})
+	err := server.SubscribeStreams(streams)
+	var refused *ResponseError
+	if errors.As(err, &refused) {
+		fmt.Printf("Error: device %s: %+v\n", id, err)
+		return nil
+	}
+	return err
+}
+
+// ListDevices returns the IDs of the devices available on the streaming server. The response lists the devices
+// separated by "|", e.g. "R device_list 2 | 9ff167 Empatica_E4 | 7a3166 Empatica_E4".
+func ListDevices(server *StreamingServer) ([]string, error) {
+	response, err := server.ListDevices()
 	if err != nil {
-		fmt.Printf("Error: %+v\n", err)
+		return nil, err
 	}
-	go func() {
-		for {
-			ds := <-server.DataStream
-			dataSet, err := json.Marshal(ds)
-			if err != nil {
-				fmt.Printf("Error: %+v\n", err)
+	entries, err := deviceEntries(response)
+	deviceList := make([]string, 0, len(entries))
+	for _, fields := range entries {
+		deviceList = append(deviceList, fields[0])
+		updateDevice(fields[0], func(d *DeviceInfo) {
+			if len(fields) > 1 {
+				d.Name = fields[1]
 			}
-			ph.AddEntry(device, dataSet)
-		}
-	}()
+		})
+	}
+	return deviceList, err
 }
 
-func ConnectToFirstE4(server *StreamingServer) error {
-	devices, err := ListDevices(server)
+// DiscoverDevices returns the IDs of the devices the Bluetooth dongle of the streaming server can reach and that
+// are allowed for its API key, e.g. "R device_discover_list 1 | 9ff167 Empatica_E4 allowed".
+func DiscoverDevices(server *StreamingServer) ([]string, error) {
+	response, err := server.DiscoverDevices()
 	if err != nil {
-		return err
-	}
-	if len(devices) < 1 {
-		return fmt.Errorf("No Device Available\n")
+		return nil, err
 	}
-	device = devices[0]
-	connection := server.ConnectDevice(device)
-	if connection.Command != "device_connect" {
-		return fmt.Errorf("Failed to conenct to device: %+v\n", connection)
+	entries, err := deviceEntries(response)
+	var deviceList []string
+	for _, fields := range entries {
+		if len(fields) < 3 || fields[2] == "allowed" {
+			deviceList = append(deviceList, fields[0])
+		}
 	}
-	server.SubscribeStreams(StreamGsr | StreamIbi | StreamTmp)
-	return nil
+	return deviceList, err
 }
 
-func ListDevices(server *StreamingServer) ([]string, error) {
-	devices := server.ListDevices()
-	numDevices, err := strconv.Atoi(devices.Arguments[0])
+// deviceEntries splits the fields of the devices of a device list response.
+func deviceEntries(response ResponseData) ([][]string, error) {
+	if len(response.Arguments) == 0 {
+		return nil, fmt.Errorf("invalid device list: %+v", response)
+	}
+	numDevices, err := strconv.Atoi(response.Arguments[0])
 	if err != nil {
 		return nil, err
 	}
-	deviceList := make([]string, numDevices)
-	for i := 0; i < numDevices; i++ {
-		deviceList[i] = devices.Arguments[i+2]
+	entries := make([][]string, 0, numDevices)
+	for _, entry := range strings.Split(strings.Join(response.Arguments[1:], " "), "|") {
+		if fields := strings.Fields(entry); len(fields) > 0 {
+			entries = append(entries, fields)
+		}
+	}
+	if len(entries) != numDevices {
+		return entries, fmt.Errorf("expected %d devices, got %d", numDevices, len(entries))
+	}
+	return entries, nil
+}
+
+// splitIDs splits a comma separated list of device IDs.
+func splitIDs(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
 	}
-	return deviceList, nil
+	return ids
 }
@@ -0,0 +1,285 @@
+// Package metrics derives physiological measures from the E4 streams while they are recorded: heart rate and heart
+// rate variability from the interbeat intervals, the tonic and phasic components of the skin conductance with skin
+// conductance responses (SCRs), and the movement intensity from the acceleration.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"viveSyncBroker/empatica"
+	"viveSyncBroker/sensor"
+)
+
+// Metrics are the measures of a device at the aligned time of its latest sample. Groups without samples are nil.
+type Metrics struct {
+	Device   string    `json:"device"`
+	Time     time.Time `json:"time"`
+	Heart    *Heart    `json:"heart,omitempty"`
+	GSR      *GSR      `json:"gsr,omitempty"`
+	Movement *Movement `json:"movement,omitempty"`
+}
+
+// Heart holds the heart rate in beats per minute and the variability in milliseconds over the window.
+type Heart struct {
+	HR    float64 `json:"hr"`
+	RMSSD float64 `json:"rmssd"`
+	SDNN  float64 `json:"sdnn"`
+	Beats int     `json:"beats"`
+}
+
+// GSR holds the skin conductance in microsiemens and the SCRs within the window.
+type GSR struct {
+	Level        float64 `json:"level"`
+	Tonic        float64 `json:"tonic"`
+	Phasic       float64 `json:"phasic"`
+	SCRs         int     `json:"scrs"`
+	SCRRate      float64 `json:"scr_rate"`
+	SCRAmplitude float64 `json:"scr_amplitude,omitempty"`
+}
+
+// Movement holds the mean intensity of the movement in g since the previous metrics.
+type Movement struct {
+	Intensity float64 `json:"intensity"`
+}
+
+// Config are the parameters of the signal processing.
+type Config struct {
+	// Window is the time over which the heart rate variability and the SCRs are computed.
+	Window time.Duration
+	// TonicTime is the time constant of the low-pass filter giving the tonic skin conductance.
+	TonicTime time.Duration
+	// SCRThreshold is the minimum amplitude of an SCR in microsiemens.
+	SCRThreshold float64
+}
+
+// ConfigFromEnv reads the parameters:
+//
+//	E4_METRICS_WINDOW:   window of heart rate variability and SCR counts, default 60s
+//	E4_METRICS_TONIC:    time constant of the tonic skin conductance, default 10s
+//	E4_SCR_THRESHOLD:    minimum SCR amplitude in microsiemens, default 0.02
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Window:       empatica.DurationEnv("E4_METRICS_WINDOW", time.Minute),
+		TonicTime:    empatica.DurationEnv("E4_METRICS_TONIC", 10*time.Second),
+		SCRThreshold: 0.02,
+	}
+	if s := os.Getenv("E4_SCR_THRESHOLD"); s != "" {
+		threshold, err := strconv.ParseFloat(s, 64)
+		if err != nil || threshold <= 0 {
+			fmt.Printf("invalid E4_SCR_THRESHOLD '%s'\n", s)
+		} else {
+			cfg.SCRThreshold = threshold
+		}
+	}
+	return cfg
+}
+
+// Processor derives the metrics of every device from its samples.
+type Processor struct {
+	cfg     Config
+	mu      sync.Mutex
+	devices map[string]*device
+}
+
+// beat is an interbeat interval in seconds, ending at a heart beat.
+type beat struct {
+	time time.Time
+	ibi  float64
+}
+
+// scr is a skin conductance response, timed at its peak.
+type scr struct {
+	time      time.Time
+	amplitude float64
+}
+
+// device is the processing state of a device.
+type device struct {
+	last     time.Time
+	aligned  time.Time
+	computed time.Time
+	// Heart
+	beats []beat
+	// GSR
+	gsrTime time.Time
+	level   float64
+	smooth  float64
+	tonic   float64
+	rising  bool
+	onset   float64
+	scrs    []scr
+	hasGSR  bool
+	// Movement
+	acc       []float64
+	movement  float64
+	accSample int
+}
+
+// NewProcessor creates a Processor.
+func NewProcessor(cfg Config) *Processor {
+	return &Processor{cfg: cfg, devices: make(map[string]*device)}
+}
+
+// Add processes a sample of an E4. Samples of other channels than ibi, gsr and acc are ignored.
+func (p *Processor) Add(s sensor.Sample) {
+	if len(s.Values) == 0 || s.Channel != "ibi" && s.Channel != "gsr" && s.Channel != "acc" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, found := p.devices[s.Sensor]
+	if !found {
+		d = &device{}
+		p.devices[s.Sensor] = d
+	}
+	switch s.Channel {
+	case "ibi":
+		d.addBeat(s.Timestamp, s.Values[0])
+	case "gsr":
+		d.addGSR(s.Timestamp, s.Values[0], p.cfg)
+	case "acc":
+		d.addAcc(s.Values)
+	}
+	if s.Timestamp.After(d.last) {
+		d.last, d.aligned = s.Timestamp, s.Time()
+	}
+}
+
+// Compute returns the current metrics of the devices with samples since the previous call, ordered by device. The
+// movement intensity starts over.
+func (p *Processor) Compute() []Metrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]Metrics, 0, len(p.devices))
+	for id, d := range p.devices {
+		if !d.last.After(d.computed) {
+			continue
+		}
+		d.computed = d.last
+		from := d.last.Add(-p.cfg.Window)
+		m := Metrics{Device: id, Time: d.aligned, Heart: d.heart(from)}
+		if d.hasGSR {
+			m.GSR = d.gsr(from, p.cfg.Window)
+		}
+		if d.accSample > 0 {
+			m.Movement = &Movement{Intensity: d.movement / float64(d.accSample)}
+			d.movement, d.accSample = 0, 0
+		}
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Device < result[j].Device
+	})
+	return result
+}
+
+// addBeat adds an interbeat interval. Intervals outside 0.3 to 2 seconds (30 to 200 bpm) are artifacts.
+func (d *device) addBeat(t time.Time, ibi float64) {
+	if ibi < 0.3 || ibi > 2 {
+		return
+	}
+	d.beats = append(d.beats, beat{time: t, ibi: ibi})
+}
+
+// heart computes the heart rate and its variability from the beats since a time. Successive differences are only
+// taken between adjacent beats, as the E4 leaves out intervals it could not detect.
+func (d *device) heart(from time.Time) *Heart {
+	for len(d.beats) > 0 && d.beats[0].time.Before(from) {
+		d.beats = d.beats[1:]
+	}
+	if len(d.beats) == 0 {
+		return nil
+	}
+	sum := 0.0
+	for _, b := range d.beats {
+		sum += b.ibi
+	}
+	mean := sum / float64(len(d.beats))
+	h := &Heart{HR: 60 / mean, Beats: len(d.beats)}
+	if len(d.beats) < 2 {
+		return h
+	}
+	squares, diffs, pairs := 0.0, 0.0, 0
+	for i, b := range d.beats {
+		squares += (b.ibi - mean) * (b.ibi - mean)
+		if i == 0 {
+			continue
+		}
+		if math.Abs(b.time.Sub(d.beats[i-1].time).Seconds()-b.ibi) < 0.2 {
+			diff := b.ibi - d.beats[i-1].ibi
+			diffs += diff * diff
+			pairs++
+		}
+	}
+	h.SDNN = 1000 * math.Sqrt(squares/float64(len(d.beats)-1))
+	if pairs > 0 {
+		h.RMSSD = 1000 * math.Sqrt(diffs/float64(pairs))
+	}
+	return h
+}
+
+// addGSR filters a skin conductance sample. The tonic component follows the level with a first order low-pass, the
+// phasic component is the rest. An SCR rises from a trough of the smoothed level to the next peak and is counted if
+// its amplitude reaches the threshold.
+func (d *device) addGSR(t time.Time, level float64, cfg Config) {
+	if !d.hasGSR {
+		d.hasGSR = true
+		d.gsrTime, d.level, d.smooth, d.tonic, d.onset = t, level, level, level, level
+		return
+	}
+	dt := t.Sub(d.gsrTime).Seconds()
+	if dt <= 0 {
+		return
+	}
+	d.gsrTime, d.level = t, level
+	// Smooth out the quantization noise of the 4 Hz samples
+	previous := d.smooth
+	d.smooth += (level - d.smooth) * (1 - math.Exp(-dt/0.5))
+	d.tonic += (level - d.tonic) * (1 - math.Exp(-dt/cfg.TonicTime.Seconds()))
+	switch {
+	case d.smooth > previous && !d.rising:
+		d.rising, d.onset = true, previous
+	case d.smooth <= previous && d.rising:
+		d.rising = false
+		if amplitude := previous - d.onset; amplitude >= cfg.SCRThreshold {
+			d.scrs = append(d.scrs, scr{time: t, amplitude: amplitude})
+		}
+	}
+}
+
+// gsr returns the skin conductance and the SCRs since a time.
+func (d *device) gsr(from time.Time, window time.Duration) *GSR {
+	for len(d.scrs) > 0 && d.scrs[0].time.Before(from) {
+		d.scrs = d.scrs[1:]
+	}
+	g := &GSR{
+		Level:   d.level,
+		Tonic:   d.tonic,
+		Phasic:  math.Max(0, d.level-d.tonic),
+		SCRs:    len(d.scrs),
+		SCRRate: float64(len(d.scrs)) / window.Minutes(),
+	}
+	if len(d.scrs) > 0 {
+		g.SCRAmplitude = d.scrs[len(d.scrs)-1].amplitude
+	}
+	return g
+}
+
+// addAcc adds the largest change of an axis since the previous acceleration sample to the movement. The values are
+// given in 1/64 g.
+func (d *device) addAcc(values []float64) {
+	if len(d.acc) == len(values) {
+		change := 0.0
+		for i, v := range values {
+			change = math.Max(change, math.Abs(v-d.acc[i]))
+		}
+		d.movement += change / 64
+		d.accSample++
+	}
+	d.acc = append(d.acc[:0], values...)
+}
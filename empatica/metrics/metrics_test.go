@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+	"viveSyncBroker/sensor"
+)
+
+func TestHeart(t *testing.T) {
+	p := NewProcessor(Config{Window: time.Minute, TonicTime: 10 * time.Second, SCRThreshold: 0.02})
+	start := time.Unix(1700000000, 0)
+	at := start
+	// The beat after the gap is not adjacent to the previous one; 2.5 s is an artifact
+	for i, ibi := range []float64{0.8, 0.9, 0.8, 0.9, 2.5, 0.8} {
+		at = at.Add(time.Duration(ibi * float64(time.Second)))
+		if i == 4 {
+			continue
+		}
+		p.Add(sensor.Sample{Sensor: "A01B2C", Channel: "ibi", Timestamp: at, Values: []float64{ibi}})
+	}
+	m := p.Compute()
+	if len(m) != 1 || m[0].Heart == nil {
+		t.Fatalf("got %+v", m)
+	}
+	h := m[0].Heart
+	// Mean 0.84 s, deviations of 40 and 60 ms, successive differences of 100 ms
+	if h.Beats != 5 || math.Abs(h.HR-60/0.84) > 1e-9 || math.Abs(h.RMSSD-100) > 1e-6 ||
+		math.Abs(h.SDNN-1000*math.Sqrt(0.012/4)) > 1e-6 {
+		t.Errorf("got %+v", h)
+	}
+	if m[0].GSR != nil || m[0].Movement != nil {
+		t.Errorf("got metrics without samples: %+v", m[0])
+	}
+}
+
+func TestGSR(t *testing.T) {
+	p := NewProcessor(Config{Window: time.Minute, TonicTime: 10 * time.Second, SCRThreshold: 0.02})
+	start := time.Unix(1700000000, 0)
+	// Two responses of 0.3 and one of 0.01 microsiemens on a level of 2
+	for i := 0; i < 4*60; i++ {
+		s := float64(i) / 4
+		level := 2.0
+		for _, response := range []struct{ onset, amplitude float64 }{{10, 0.3}, {30, 0.3}, {50, 0.01}} {
+			if since := s - response.onset; since > 0 {
+				level += response.amplitude * (1 - math.Exp(-since/0.7)) * math.Exp(-since/4) / 0.6
+			}
+		}
+		p.Add(sensor.Sample{Sensor: "A01B2C", Channel: "gsr",
+			Timestamp: start.Add(time.Duration(s * float64(time.Second))), Values: []float64{level}})
+	}
+	g := p.Compute()[0].GSR
+	if g == nil || g.SCRs != 2 || g.SCRRate != 2 || g.Tonic < 2 || g.Tonic > 2.1 || g.SCRAmplitude < 0.25 {
+		t.Errorf("got %+v", g)
+	}
+}
+
+func TestMovement(t *testing.T) {
+	p := NewProcessor(Config{Window: time.Minute, TonicTime: 10 * time.Second, SCRThreshold: 0.02})
+	start := time.Unix(1700000000, 0)
+	for i, acc := range [][]float64{{0, 0, 64}, {32, 0, 64}, {32, 16, 64}} {
+		p.Add(sensor.Sample{Sensor: "A01B2C", Channel: "acc",
+			Timestamp: start.Add(time.Duration(i) * time.Second / 32), Values: acc})
+	}
+	if m := p.Compute()[0].Movement; m == nil || m.Intensity != 0.375 {
+		t.Errorf("got %+v", m)
+	}
+	p.Add(sensor.Sample{Sensor: "A01B2C", Channel: "acc", Timestamp: start.Add(time.Second),
+		Values: []float64{32, 16, 64}})
+	if m := p.Compute()[0].Movement; m == nil || m.Intensity != 0 {
+		t.Errorf("movement not reset: %+v", m)
+	}
+	if m := p.Compute(); len(m) != 0 {
+		t.Errorf("got metrics without new samples: %+v", m)
+	}
+}
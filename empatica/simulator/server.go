@@ -0,0 +1,321 @@
+// Package simulator implements a fake E4 streaming server for development and tests without the Windows streaming
+// server and a wristband. It speaks the line protocol of the streaming server and streams synthetic or recorded
+// signals. Faults like dropped connections and devices losing their Bluetooth connection can be injected.
+package simulator
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamNames are the data line names of the streams. The heart rate is sent with the subscription of the interbeat
+// intervals.
+var streamNames = map[string]string{
+	"acc": "E4_Acc",
+	"bvp": "E4_Bvp",
+	"gsr": "E4_Gsr",
+	"ibi": "E4_Ibi",
+	"tmp": "E4_Temperature",
+	"bat": "E4_Battery",
+	"tag": "E4_Tag",
+	"hr":  "E4_Hr",
+}
+
+// Server is a fake streaming server. Every client connection can connect one device, like with the real server.
+type Server struct {
+	// Devices are the IDs of the available wristbands.
+	Devices []string
+	// Source creates the signals of a connected device.
+	Source Source
+	// CommaDecimals writes decimals with a comma, like the streaming server on a German Windows.
+	CommaDecimals bool
+	// Tick is the interval in which samples are written.
+	Tick time.Duration
+	// DropAfter closes every client connection after a time, if set.
+	DropAfter time.Duration
+	listener  net.Listener
+	mu        sync.Mutex
+	clients   map[*client]bool
+	lost      map[string]bool
+}
+
+// client is a connection to the Server.
+type client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	device  string
+	streams map[string]bool
+	paused  bool
+	start   time.Time
+	done    chan struct{}
+}
+
+// New creates a Server with synthetic signals for the given devices.
+func New(devices ...string) *Server {
+	return &Server{
+		Devices: devices,
+		Source:  Synthetic{},
+		Tick:    50 * time.Millisecond,
+		clients: make(map[*client]bool),
+		lost:    make(map[string]bool),
+	}
+}
+
+// Listen accepts clients on an address, e.g. "127.0.0.1:28000" or "127.0.0.1:0" for a free port.
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := &client{conn: conn, streams: make(map[string]bool), done: make(chan struct{})}
+			s.mu.Lock()
+			s.clients[c] = true
+			s.mu.Unlock()
+			if s.DropAfter > 0 {
+				time.AfterFunc(s.DropAfter, func() {
+					_ = conn.Close()
+				})
+			}
+			go s.serve(c)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the Server listens on.
+func (s *Server) Addr() *net.TCPAddr {
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+// Close stops accepting clients and closes all client connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.Disconnect()
+	return err
+}
+
+// Disconnect closes all client connections, like a crashing streaming server.
+func (s *Server) Disconnect() {
+	for _, c := range s.connected("") {
+		_ = c.conn.Close()
+	}
+}
+
+// LoseDevice lets a device lose its Bluetooth connection. Its clients are notified and receive no samples until the
+// connection is re-established.
+func (s *Server) LoseDevice(id string) {
+	s.mu.Lock()
+	s.lost[id] = true
+	s.mu.Unlock()
+	for _, c := range s.connected(id) {
+		c.send("R connection lost to device " + id)
+	}
+}
+
+// ReestablishDevice ends the Bluetooth connection loss of a device.
+func (s *Server) ReestablishDevice(id string) {
+	s.mu.Lock()
+	delete(s.lost, id)
+	s.mu.Unlock()
+	for _, c := range s.connected(id) {
+		c.send("R connection re-established to device " + id)
+	}
+}
+
+// Tag sends a tag, like a press on the button of a device, to the clients subscribed to its tag stream.
+func (s *Server) Tag(id string) {
+	for _, c := range s.connected(id) {
+		c.mu.Lock()
+		subscribed := c.streams["tag"]
+		c.mu.Unlock()
+		if subscribed {
+			c.send("E4_Tag " + s.format(float64(time.Now().UnixNano())/1e9, 6))
+		}
+	}
+}
+
+// connected returns the clients connected to a device, or all clients if id is empty.
+func (s *Server) connected(id string) []*client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var clients []*client
+	for c := range s.clients {
+		c.mu.Lock()
+		if id == "" || c.device == id {
+			clients = append(clients, c)
+		}
+		c.mu.Unlock()
+	}
+	return clients
+}
+
+// serve answers the commands of a client until it disconnects.
+func (s *Server) serve(c *client) {
+	defer func() {
+		close(c.done)
+		_ = c.conn.Close()
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		c.send(s.handle(c, fields[0], fields[1:]))
+	}
+}
+
+// handle executes a command of a client and returns the response line.
+func (s *Server) handle(c *client, cmd string, args []string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cmd {
+	case "server_status":
+		return "R server_status OK"
+	case "device_list", "device_discover_list":
+		entries := []string{strconv.Itoa(len(s.Devices))}
+		for _, id := range s.Devices {
+			entry := id + " Empatica_E4"
+			if cmd == "device_discover_list" {
+				entry += " allowed"
+			}
+			entries = append(entries, entry)
+		}
+		return "R " + cmd + " " + strings.Join(entries, " | ")
+	case "device_connect":
+		if len(args) == 0 || !s.available(args[0]) {
+			return "R device_connect ERR The requested device is not available."
+		}
+		if c.device != "" {
+			return "R device_connect ERR You are already connected to a device."
+		}
+		c.device = args[0]
+		c.start = time.Now()
+		go s.stream(c, s.Source.Open(c.device))
+		return "R device_connect OK"
+	case "device_disconnect":
+		if c.device == "" {
+			return "R device_disconnect ERR No connected device."
+		}
+		// The streaming goroutine ends with the device
+		c.device = ""
+		c.streams = make(map[string]bool)
+		return "R device_disconnect OK"
+	case "device_subscribe":
+		if len(args) < 2 {
+			return "R device_subscribe ERR Wrong number of arguments."
+		}
+		if _, found := streamNames[args[0]]; !found || args[0] == "hr" {
+			return "R device_subscribe " + args[0] + " ERR The requested stream is not available."
+		}
+		if c.device == "" {
+			return "R device_subscribe " + args[0] + " ERR You are not connected to any device"
+		}
+		c.streams[args[0]] = args[1] == "ON"
+		return "R device_subscribe " + args[0] + " OK"
+	case "pause":
+		if c.device == "" {
+			return "R pause ERR You are not connected to any device"
+		}
+		c.paused = len(args) > 0 && args[0] == "ON"
+		if c.paused {
+			return "R pause ON"
+		}
+		return "R pause OFF"
+	}
+	return "R " + cmd + " ERR Unknown command."
+}
+
+// available reports if a device is listed.
+func (s *Server) available(id string) bool {
+	for _, device := range s.Devices {
+		if device == id {
+			return true
+		}
+	}
+	return false
+}
+
+// stream writes the due samples of the subscribed streams every tick until the device is disconnected. Samples of a
+// paused client or a lost device are dropped.
+func (s *Server) stream(c *client, signal Signal) {
+	c.mu.Lock()
+	device, start := c.device, c.start
+	c.mu.Unlock()
+	ticker := time.NewTicker(s.Tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		lost := s.lost[device]
+		s.mu.Unlock()
+		c.mu.Lock()
+		if c.device != device || c.start != start {
+			c.mu.Unlock()
+			return
+		}
+		var lines []string
+		for _, sample := range signal.Until(time.Since(start)) {
+			subscription := sample.Stream
+			if subscription == "hr" {
+				subscription = "ibi"
+			}
+			if lost || c.paused || !c.streams[subscription] {
+				continue
+			}
+			lines = append(lines, s.line(start, sample))
+		}
+		c.mu.Unlock()
+		for _, line := range lines {
+			c.send(line)
+		}
+	}
+}
+
+// line formats a sample as data line.
+func (s *Server) line(start time.Time, sample Sample) string {
+	ts := s.format(float64(start.Add(sample.Offset).UnixNano())/1e9, 6)
+	values := make([]string, len(sample.Values))
+	for i, v := range sample.Values {
+		values[i] = s.format(v, -1)
+	}
+	return strings.TrimSpace(streamNames[sample.Stream] + " " + ts + " " + strings.Join(values, " "))
+}
+
+// format writes a number with a decimal point or comma.
+func (s *Server) format(v float64, precision int) string {
+	str := strconv.FormatFloat(v, 'f', precision, 64)
+	if s.CommaDecimals {
+		str = strings.Replace(str, ".", ",", 1)
+	}
+	return str
+}
+
+// send writes a line to the client.
+func (c *client) send(line string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", line); err != nil {
+		_ = c.conn.Close()
+	}
+}
@@ -0,0 +1,184 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+// Sample is a value of a stream at an offset from the start of the device connection. Streams are named like in
+// device_subscribe, e.g. "gsr"; the values of "ibi" are interbeat intervals in seconds, those of "hr" the heart rate
+// in beats per minute.
+type Sample struct {
+	Stream string
+	Offset time.Duration
+	Values []float64
+}
+
+// Source creates the signals of the devices.
+type Source interface {
+	Open(device string) Signal
+}
+
+// Signal yields the samples of a device in order of their offsets.
+type Signal interface {
+	// Until returns the samples before an offset that were not returned yet.
+	Until(offset time.Duration) []Sample
+}
+
+// Synthetic generates plausible signals at the sampling rates of the E4: a pulse wave, a heart rate with some
+// variability, a skin conductance level with a response every 20 seconds, wrist movement, temperature and a slowly
+// draining battery.
+type Synthetic struct{}
+
+// syntheticRates are the sampling periods of the regular streams.
+var syntheticRates = map[string]time.Duration{
+	"acc": time.Second / 32,
+	"bvp": time.Second / 64,
+	"gsr": time.Second / 4,
+	"tmp": time.Second / 4,
+	"bat": 10 * time.Second,
+}
+
+// syntheticSignal is the state of a synthetic device.
+type syntheticSignal struct {
+	next  map[string]time.Duration
+	beats int
+}
+
+// Open starts the synthetic signals of a device.
+func (Synthetic) Open(device string) Signal {
+	return &syntheticSignal{next: make(map[string]time.Duration)}
+}
+
+// Until generates the samples of all streams before an offset.
+func (s *syntheticSignal) Until(offset time.Duration) []Sample {
+	var samples []Sample
+	for stream, period := range syntheticRates {
+		for t := s.next[stream]; t < offset; t += period {
+			samples = append(samples, Sample{Stream: stream, Offset: t, Values: syntheticValues(stream, t.Seconds())})
+			s.next[stream] = t + period
+		}
+	}
+	// The interval is sent with the beat ending it
+	for {
+		ibi := 0.8 + 0.05*math.Sin(float64(s.beats)*0.7)
+		t := s.next["ibi"] + time.Duration(ibi*float64(time.Second))
+		if t >= offset {
+			break
+		}
+		s.beats++
+		s.next["ibi"] = t
+		samples = append(samples, Sample{Stream: "ibi", Offset: t, Values: []float64{ibi}},
+			Sample{Stream: "hr", Offset: t, Values: []float64{60 / ibi}})
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Offset < samples[j].Offset
+	})
+	return samples
+}
+
+// syntheticValues returns the values of a regular stream at a time in seconds.
+func syntheticValues(stream string, t float64) []float64 {
+	switch stream {
+	case "acc":
+		return []float64{math.Round(10 * math.Sin(t)), math.Round(5 * math.Cos(t/2)), 62}
+	case "bvp":
+		return []float64{50 * math.Sin(2*math.Pi*1.2*t)}
+	case "gsr":
+		// Tonic level with a phasic response rising one second after every 20 seconds
+		level := 2 + 0.1*math.Sin(t/30)
+		if since := math.Mod(t, 20) - 1; since > 0 {
+			level += 0.3 * (1 - math.Exp(-since/0.7)) * math.Exp(-since/4)
+		}
+		return []float64{level}
+	case "tmp":
+		return []float64{32.5 + 0.2*math.Sin(t/60)}
+	case "bat":
+		return []float64{math.Max(0, 1-t/36000)}
+	}
+	return nil
+}
+
+// Replay plays the E4 samples of a recording with their original timing, relative to the first sample.
+type Replay struct {
+	devices map[string][]Sample
+	first   string
+}
+
+// LoadReplay reads the "e4_<stream>" records of a persistence file.
+func LoadReplay(file string) (*Replay, error) {
+	records, err := persistence.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replay{devices: make(map[string][]Sample)}
+	var start time.Time
+	for _, rec := range records {
+		if !strings.HasPrefix(rec.Command, "e4_") || rec.Command == "e4_status" {
+			continue
+		}
+		ds := struct {
+			Device    string    `json:"device"`
+			Stream    string    `json:"stream"`
+			Timestamp time.Time `json:"timestamp"`
+			Values    []float64 `json:"values"`
+		}{}
+		if err := json.Unmarshal(rec.Data, &ds); err != nil || ds.Stream == "" {
+			continue
+		}
+		if start.IsZero() || ds.Timestamp.Before(start) {
+			start = ds.Timestamp
+		}
+		if _, found := r.devices[ds.Device]; !found && r.first == "" {
+			r.first = ds.Device
+		}
+		r.devices[ds.Device] = append(r.devices[ds.Device], Sample{
+			Stream: ds.Stream,
+			// The offset is relative to the first sample once all are read
+			Offset: time.Duration(ds.Timestamp.UnixNano()),
+			Values: ds.Values,
+		})
+	}
+	if len(r.devices) == 0 {
+		return nil, fmt.Errorf("no E4 samples in '%s'", file)
+	}
+	for device, samples := range r.devices {
+		for i := range samples {
+			samples[i].Offset -= time.Duration(start.UnixNano())
+		}
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Offset < samples[j].Offset
+		})
+		r.devices[device] = samples
+	}
+	return r, nil
+}
+
+// replaySignal is the position within the samples of a device.
+type replaySignal struct {
+	samples []Sample
+}
+
+// Open starts the samples of a device, or of the first recorded device if the device was not recorded.
+func (r *Replay) Open(device string) Signal {
+	samples, found := r.devices[device]
+	if !found {
+		samples = r.devices[r.first]
+	}
+	return &replaySignal{samples: samples}
+}
+
+// Until returns the recorded samples before an offset.
+func (s *replaySignal) Until(offset time.Duration) []Sample {
+	n := sort.Search(len(s.samples), func(i int) bool {
+		return s.samples[i].Offset >= offset
+	})
+	due := s.samples[:n]
+	s.samples = s.samples[n:]
+	return due
+}
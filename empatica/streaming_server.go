@@ -3,18 +3,45 @@ package empatica
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/bits"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// DefaultTimeout is the time the streaming server has to answer a request.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	// ErrTimeout is returned if the streaming server does not answer a request in time.
+	ErrTimeout = errors.New("no response from the streaming server")
+	// ErrClosed is returned for requests on a closed connection.
+	ErrClosed = errors.New("connection to the streaming server closed")
+)
+
+// StreamingData is a sample of a device. The Timestamp is given by the clock of the streaming server; Aligned is
+// the Timestamp on the broker's clock, with the Uncertainty of the alignment in seconds.
 type StreamingData struct {
-	Stream    StreamType `json:"stream"`
-	Timestamp time.Time  `json:"timestamp"`
-	Values    []float64  `json:"values"`
+	Device      string     `json:"device,omitempty"`
+	Stream      StreamType `json:"stream"`
+	Timestamp   time.Time  `json:"timestamp"`
+	Values      []float64  `json:"values"`
+	Aligned     time.Time  `json:"aligned,omitempty"`
+	Uncertainty float64    `json:"uncertainty,omitempty"`
+	Received    time.Time  `json:"-"`
+}
+
+// Time returns the aligned timestamp, or the timestamp of the streaming server if the sample is not aligned.
+func (ds StreamingData) Time() time.Time {
+	if ds.Aligned.IsZero() {
+		return ds.Timestamp
+	}
+	return ds.Aligned
 }
 
 type ResponseData struct {
@@ -22,12 +49,49 @@ type ResponseData struct {
 	Arguments []string
 }
 
+// ResponseError is an error response of the streaming server, e.g. "R device_connect ERR The requested device is
+// not available."
+type ResponseError struct {
+	Command string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Command, e.Message)
+}
+
+// Err returns the error of an error response. The error follows the command, or the stream of device_subscribe.
+func (r ResponseData) Err() error {
+	for i, arg := range r.Arguments {
+		if i > 1 {
+			break
+		}
+		if arg == "ERR" {
+			return &ResponseError{Command: r.Command, Message: strings.Join(r.Arguments[i+1:], " ")}
+		}
+	}
+	return nil
+}
+
+// StreamingServer is a connection to the E4 streaming server. Requests are answered in order, so responses are
+// passed to the oldest pending request with the same command, and the same stream for device_subscribe.
 type StreamingServer struct {
 	Addr       net.TCPAddr
 	Conn       *net.TCPConn
-	Recv       chan ResponseData
+	Timeout    time.Duration
 	DataStream chan StreamingData
-	conbuf     *bufio.Reader
+	Events     chan ResponseData
+	requestMu  sync.Mutex
+	mu         sync.Mutex
+	pending    map[string][]*waiter
+	sent       uint64
+}
+
+// waiter is a pending request, numbered in the order the requests were sent.
+type waiter struct {
+	seq      uint64
+	response chan ResponseData
+	timedOut bool
 }
 
 type StreamType uint
@@ -40,8 +104,12 @@ const (
 	StreamTmp StreamType = 1 << 4
 	StreamBat StreamType = 1 << 5
 	StreamTag StreamType = 1 << 6
+	StreamHr  StreamType = 1 << 7
 )
 
+// allStreams are the streams that can be subscribed. The heart rate is sent with the interbeat intervals.
+const allStreams = StreamAcc | StreamBvp | StreamGsr | StreamIbi | StreamTmp | StreamBat | StreamTag
+
 var streamTypeStrings = []string{
 	"acc",
 	"bvp",
@@ -50,6 +118,7 @@ var streamTypeStrings = []string{
 	"tmp",
 	"bat",
 	"tag",
+	"hr",
 }
 
 var streamResolveTypes = map[string]StreamType{
@@ -57,14 +126,15 @@ var streamResolveTypes = map[string]StreamType{
 	"E4_Bvp":         StreamBvp,
 	"E4_Gsr":         StreamGsr,
 	"E4_Temperature": StreamTmp,
-	"E4_Hr":          StreamIbi, // IBI = 1/HR
+	"E4_Ibi":         StreamIbi,
+	"E4_Hr":          StreamHr,
 	"E4_Battery":     StreamBat,
 	"E4_Tag":         StreamTag,
 }
 
 func (st StreamType) String() string {
 	n := st
-	for i := 0; i < 7; i++ {
+	for i := 0; i < len(streamTypeStrings); i++ {
 		if n == 1 {
 			return streamTypeStrings[i]
 		}
@@ -82,7 +152,7 @@ func (st StreamType) MarshalJSON() ([]byte, error) {
 
 func (st StreamType) Strings() []string {
 	result := make([]string, 0, bits.OnesCount(uint(st)))
-	for i := 0; i < 7; i++ {
+	for i := 0; i < len(streamTypeStrings); i++ {
 		if st&(1<<i) == 1<<i {
 			result = append(result, streamTypeStrings[i])
 		}
@@ -96,42 +166,142 @@ func NewStreamingServer(address string, port int) *StreamingServer {
 			IP:   net.ParseIP(address),
 			Port: port,
 		},
+		Timeout: DefaultTimeout,
 	}
 }
 
+// Connect opens the connection to the streaming server. Unsolicited responses, like a device losing its connection,
+// are passed to Events. When the connection ends, pending requests fail with ErrClosed and the DataStream and Events
+// channels are closed.
 func (s *StreamingServer) Connect() error {
 	var err error
 	s.Conn, err = net.DialTCP("tcp", nil, &s.Addr)
 	if err != nil {
 		return err
 	}
-	s.Recv = make(chan ResponseData)
-	s.DataStream = make(chan StreamingData)
-	go func() {
-		for {
-			s.conbuf = bufio.NewReader(s.Conn)
-			str, err := s.conbuf.ReadString('\n')
+	// Samples are buffered while the streams are subscribed and before they are read
+	s.DataStream = make(chan StreamingData, 1024)
+	s.Events = make(chan ResponseData, 16)
+	s.pending = make(map[string][]*waiter)
+	go s.read(bufio.NewReader(s.Conn))
+	return nil
+}
+
+// read passes the lines of the streaming server to the pending requests, Events and DataStream until the connection
+// ends.
+func (s *StreamingServer) read(reader *bufio.Reader) {
+	defer func() {
+		s.mu.Lock()
+		for _, waiting := range s.pending {
+			for _, w := range waiting {
+				close(w.response)
+			}
+		}
+		s.pending = nil
+		s.mu.Unlock()
+		close(s.DataStream)
+		close(s.Events)
+	}()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Error: %+v\n", err)
+			}
+			_ = s.Conn.Close()
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if isResponse(line) {
+			response, err := parseResponse(line)
 			if err != nil {
 				fmt.Printf("Error: %+v\n", err)
+				continue
 			}
-			str = strings.Trim(str, "\r\n")
-			//			fmt.Printf("-- %s --\n", str)
-			if isResponse(str) {
-				s.Recv <- parseResponse(str)
-			} else {
-				streamData := parseStream(str)
-				if streamData != nil {
-					s.DataStream <- *streamData
-				}
+			s.dispatch(response)
+			continue
+		}
+		streamData, err := parseStream(line)
+		if err != nil {
+			fmt.Printf("Error: %+v\n", err)
+		} else if streamData != nil {
+			streamData.Received = time.Now()
+			s.DataStream <- *streamData
+		}
+	}
+}
+
+// dispatch passes a response to the oldest pending request of its command, or to Events. Responses that do not name
+// a stream of device_subscribe go to its oldest request of any stream. As requests are answered in order, timed out
+// requests sent before the answered one will not be answered anymore and are dropped.
+func (s *StreamingServer) dispatch(response ResponseData) {
+	s.mu.Lock()
+	key := responseKey(response)
+	if len(s.pending[key]) == 0 {
+		for k, waiting := range s.pending {
+			if strings.HasPrefix(k, response.Command+" ") && len(waiting) > 0 &&
+				(len(s.pending[key]) == 0 || waiting[0].seq < s.pending[key][0].seq) {
+				key = k
 			}
 		}
-	}()
-	return nil
+	}
+	waiting := s.pending[key]
+	if len(waiting) > 0 {
+		s.pending[key] = waiting[1:]
+		s.dropTimedOut(waiting[0].seq)
+		s.mu.Unlock()
+		waiting[0].response <- response
+		return
+	}
+	s.mu.Unlock()
+	if !isEvent(response) {
+		fmt.Printf("Unexpected response: %+v\n", response)
+		return
+	}
+	select {
+	case s.Events <- response:
+	default:
+	}
+}
+
+// dropTimedOut removes the timed out requests sent before a request. The caller has to hold the lock.
+func (s *StreamingServer) dropTimedOut(seq uint64) {
+	for key, waiting := range s.pending {
+		kept := waiting[:0]
+		for _, w := range waiting {
+			if !w.timedOut || w.seq > seq {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.pending, key)
+		} else {
+			s.pending[key] = kept
+		}
+	}
+}
+
+// requestKey identifies the pending requests a response can answer: the command, and the stream for
+// device_subscribe, whose responses name the stream.
+func requestKey(cmd string, args ...string) string {
+	if cmd == "device_subscribe" && len(args) > 0 {
+		return cmd + " " + strings.ToLower(args[0])
+	}
+	return cmd
+}
+
+// responseKey returns the requestKey of the request a response answers.
+func responseKey(response ResponseData) string {
+	return requestKey(response.Command, response.Arguments...)
+}
+
+// Close closes the connection to the streaming server.
+func (s *StreamingServer) Close() error {
+	return s.Conn.Close()
 }
 
 func (s *StreamingServer) Send(cmd string, args ...string) error {
 	cmdPlain := command(cmd, args...)
-	//	fmt.Printf(">> %s <<\n", cmdPlain)
 	_, err := s.Conn.Write(cmdPlain)
 	if err != nil {
 		return err
@@ -139,66 +309,182 @@ func (s *StreamingServer) Send(cmd string, args ...string) error {
 	return nil
 }
 
-func (s *StreamingServer) ListDevices() ResponseData {
-	err := s.Send("device_list")
+// Request sends a command and waits for its response. Error responses are returned as *ResponseError. A request
+// that timed out keeps its place, so a late response does not answer the next request of the command, until a
+// later request is answered.
+func (s *StreamingServer) Request(cmd string, args ...string) (ResponseData, error) {
+	w := &waiter{response: make(chan ResponseData, 1)}
+	key := requestKey(cmd, args...)
+	s.requestMu.Lock()
+	s.mu.Lock()
+	if s.pending == nil {
+		s.mu.Unlock()
+		s.requestMu.Unlock()
+		return ResponseData{}, ErrClosed
+	}
+	s.sent++
+	w.seq = s.sent
+	s.pending[key] = append(s.pending[key], w)
+	s.mu.Unlock()
+	err := s.Send(cmd, args...)
+	s.requestMu.Unlock()
 	if err != nil {
-		fmt.Printf("Error: %+v\n", err)
+		return ResponseData{}, err
+	}
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-w.response:
+		if !ok {
+			return response, ErrClosed
+		}
+		return response, response.Err()
+	case <-timer.C:
+		s.mu.Lock()
+		w.timedOut = true
+		s.mu.Unlock()
+		return ResponseData{}, fmt.Errorf("%s: %w", cmd, ErrTimeout)
 	}
-	return <-s.Recv
 }
 
-func (s *StreamingServer) ConnectDevice(id string) ResponseData {
-	err := s.Send("device_connect", id)
-	if err != nil {
-		fmt.Printf("Error: %+v\n", err)
+// ListDevices requests the devices connected to the streaming server.
+func (s *StreamingServer) ListDevices() (ResponseData, error) {
+	return s.Request("device_list")
+}
+
+// DiscoverDevices requests the devices the Bluetooth dongle of the streaming server can reach.
+func (s *StreamingServer) DiscoverDevices() (ResponseData, error) {
+	return s.Request("device_discover_list")
+}
+
+// ConnectDevice connects a device to this connection.
+func (s *StreamingServer) ConnectDevice(id string) error {
+	_, err := s.Request("device_connect", id)
+	return err
+}
+
+// DisconnectDevice disconnects the device of this connection.
+func (s *StreamingServer) DisconnectDevice() error {
+	_, err := s.Request("device_disconnect")
+	return err
+}
+
+// SubscribeStreams starts the given streams of the connected device. All streams are requested; the first error is
+// returned.
+func (s *StreamingServer) SubscribeStreams(streams StreamType) error {
+	return s.subscribe(streams, "ON")
+}
+
+// UnsubscribeStreams stops the given streams of the connected device.
+func (s *StreamingServer) UnsubscribeStreams(streams StreamType) error {
+	return s.subscribe(streams, "OFF")
+}
+
+// subscribe switches streams on or off.
+func (s *StreamingServer) subscribe(streams StreamType, state string) error {
+	var first error
+	for _, stream := range (streams & allStreams).Strings() {
+		if _, err := s.Request("device_subscribe", stream, state); err != nil && first == nil {
+			first = err
+		}
 	}
-	return <-s.Recv
+	return first
 }
 
-func (s *StreamingServer) SubscribeStreams(streams StreamType) {
-	for _, stream := range streams.Strings() {
-		err := s.Send("device_subscribe", stream, "ON")
-		if err != nil {
-			fmt.Printf("Error: %+v\n", err)
+// Pause stops or resumes sending samples without changing the subscriptions.
+func (s *StreamingServer) Pause(on bool) error {
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+	_, err := s.Request("pause", state)
+	return err
+}
+
+// ParseStreams combines stream names like "gsr" and "bvp" to a StreamType. "all" selects every stream; "hr" selects
+// the interbeat intervals, which include the heart rate.
+func ParseStreams(names []string) (StreamType, error) {
+	var streams StreamType
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "all":
+			streams |= allStreams
+			continue
+		case "hr":
+			streams |= StreamIbi
+			continue
+		}
+		found := false
+		for i, s := range streamTypeStrings {
+			if s == name {
+				streams |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return streams, fmt.Errorf("unknown stream '%s'", name)
 		}
-		fmt.Printf("Subscribed: %+v\n", <-s.Recv)
 	}
+	return streams, nil
+}
+
+// isEvent reports if a response is sent by the streaming server on its own, e.g. "R connection lost to device 9ff167"
+// and "R connection re-established to device 9ff167".
+func isEvent(r ResponseData) bool {
+	return r.Command == "connection"
 }
 
 func isResponse(s string) bool {
 	return strings.HasPrefix(s, "R ")
 }
 
-func parseResponse(cmd string) ResponseData {
-	parts := strings.Split(cmd, " ")
+// parseResponse splits a response line like "R device_subscribe gsr OK" into command and arguments.
+func parseResponse(line string) (ResponseData, error) {
+	parts := strings.Fields(line)
+	if len(parts) < 2 || parts[0] != "R" {
+		return ResponseData{}, fmt.Errorf("invalid response '%s'", line)
+	}
 	return ResponseData{
 		Command:   parts[1],
 		Arguments: parts[2:],
-	}
+	}, nil
 }
 
-func parseStream(cmd string) *StreamingData {
-	parts := strings.Split(cmd, " ")
+// parseStream parses a data line like "E4_Gsr 1495015463,99875 0,20". Decimals may be written with a comma. Lines of
+// unknown streams are ignored and return nil.
+func parseStream(line string) (*StreamingData, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return nil, nil
+	}
 	st, found := streamResolveTypes[parts[0]]
 	if !found {
-		return nil
+		return nil, nil
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("missing timestamp in '%s'", line)
 	}
-	ts, err := strconv.ParseFloat(strings.Replace(parts[1], ",", ".", 1), 64)
+	ts, err := parseDecimal(parts[1])
 	if err != nil {
-		fmt.Printf("Error: %+v\n", err)
+		return nil, fmt.Errorf("invalid timestamp in '%s'", line)
 	}
 	values := make([]float64, len(parts)-2)
 	for i := 2; i < len(parts); i++ {
-		values[i-2], err = strconv.ParseFloat(strings.Replace(parts[i], ",", ".", 1), 64)
-		if err != nil {
-			fmt.Printf("Error: %+v\n", err)
+		if values[i-2], err = parseDecimal(parts[i]); err != nil {
+			return nil, fmt.Errorf("invalid value in '%s'", line)
 		}
 	}
 	return &StreamingData{
 		Stream:    st,
-		Timestamp: time.UnixMicro(int64(ts * 1000000)),
+		Timestamp: time.UnixMicro(int64(math.Round(ts * 1000000))),
 		Values:    values,
-	}
+	}, nil
+}
+
+// parseDecimal parses a number with a decimal point or comma.
+func parseDecimal(s string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
 }
 
 func command(cmd string, args ...string) []byte {
@@ -0,0 +1,311 @@
+package empatica
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"viveSyncBroker/empatica/simulator"
+)
+
+func TestParseStream(t *testing.T) {
+	tests := []struct {
+		line   string
+		stream StreamType
+		time   time.Time
+		values []float64
+	}{
+		{"E4_Gsr 1495015463.99875 0.20", StreamGsr, time.UnixMicro(1495015463998750), []float64{0.2}},
+		{"E4_Acc 1495015463,5 -12 3 62", StreamAcc, time.UnixMicro(1495015463500000), []float64{-12, 3, 62}},
+		{"E4_Hr 1495015464,25 72,5", StreamHr, time.UnixMicro(1495015464250000), []float64{72.5}},
+		{"E4_Ibi 1495015464,25 0,828", StreamIbi, time.UnixMicro(1495015464250000), []float64{0.828}},
+		{"E4_Temperature 1495015464 32,51", StreamTmp, time.UnixMicro(1495015464000000), []float64{32.51}},
+		{"E4_Tag 1495015465.125", StreamTag, time.UnixMicro(1495015465125000), []float64{}},
+	}
+	for _, test := range tests {
+		ds, err := parseStream(test.line)
+		if err != nil || ds == nil {
+			t.Errorf("%q: no sample, %v", test.line, err)
+			continue
+		}
+		if ds.Stream != test.stream || !ds.Timestamp.Equal(test.time) || !reflect.DeepEqual(ds.Values, test.values) {
+			t.Errorf("%q: got %s %s %v, want %s %s %v", test.line, ds.Stream, ds.Timestamp, ds.Values,
+				test.stream, test.time, test.values)
+		}
+	}
+	for _, line := range []string{"E4_Unknown 1495015463 1", ""} {
+		if ds, err := parseStream(line); ds != nil || err != nil {
+			t.Errorf("%q: got %+v, %v", line, ds, err)
+		}
+	}
+	for _, line := range []string{"E4_Gsr", "E4_Gsr x 0,2", "E4_Gsr 1495015463 0,2,1"} {
+		if ds, err := parseStream(line); ds != nil || err == nil {
+			t.Errorf("%q: got %+v without error", line, ds)
+		}
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		line     string
+		response ResponseData
+	}{
+		{"R device_connect OK", ResponseData{"device_connect", []string{"OK"}}},
+		{"R device_subscribe gsr OK", ResponseData{"device_subscribe", []string{"gsr", "OK"}}},
+		{"R device_list 1 | 9ff167 Empatica_E4", ResponseData{"device_list", []string{"1", "|", "9ff167", "Empatica_E4"}}},
+		{"R connection lost to device 9ff167", ResponseData{"connection", []string{"lost", "to", "device", "9ff167"}}},
+	}
+	for _, test := range tests {
+		if !isResponse(test.line) {
+			t.Errorf("%q: not recognized as response", test.line)
+		}
+		response, err := parseResponse(test.line)
+		if err != nil || !reflect.DeepEqual(response, test.response) {
+			t.Errorf("%q: got %+v, %v, want %+v", test.line, response, err, test.response)
+		}
+	}
+	if isResponse("E4_Gsr 1495015463 0,2") {
+		t.Error("data line recognized as response")
+	}
+	for _, line := range []string{"R", "R ", "R  "} {
+		if _, err := parseResponse(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestResponseErr(t *testing.T) {
+	tests := []struct {
+		response ResponseData
+		message  string
+	}{
+		{ResponseData{"device_connect", []string{"OK"}}, ""},
+		{ResponseData{"device_connect", []string{"ERR", "The", "requested", "device", "is", "not", "available."}},
+			"The requested device is not available."},
+		{ResponseData{"device_subscribe", []string{"gsr", "ERR", "You", "are", "not", "connected"}}, "You are not connected"},
+		{ResponseData{"device_list", []string{"1", "|", "ERR", "Empatica_E4"}}, ""},
+	}
+	for _, test := range tests {
+		err := test.response.Err()
+		var re *ResponseError
+		if test.message == "" && err != nil || test.message != "" && (!errors.As(err, &re) || re.Message != test.message) {
+			t.Errorf("%+v: got %v, want %q", test.response, err, test.message)
+		}
+	}
+}
+
+// startSimulator runs a simulated streaming server with comma decimals and connects a StreamingServer to it.
+func startSimulator(t *testing.T, devices ...string) (*simulator.Server, *StreamingServer) {
+	sim := simulator.New(devices...)
+	sim.CommaDecimals = true
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sim.Close()
+	})
+	server := NewStreamingServer("127.0.0.1", sim.Addr().Port)
+	if err := server.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return sim, server
+}
+
+func TestStreamingServer(t *testing.T) {
+	sim, server := startSimulator(t, "A01B2C", "7F3E21")
+	ids, err := ListDevices(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"A01B2C", "7F3E21"}) {
+		t.Fatalf("got devices %v", ids)
+	}
+	if err = ConnectE4(server, "A01B2C", StreamGsr); err != nil {
+		t.Fatal(err)
+	}
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case ds := <-server.DataStream:
+			if ds.Stream != StreamGsr || len(ds.Values) != 1 || ds.Values[0] < 1 || ds.Values[0] > 3 {
+				t.Fatalf("unexpected sample %+v", ds)
+			}
+			if !ds.Timestamp.After(last) {
+				t.Fatalf("sample at %s not after %s", ds.Timestamp, last)
+			}
+			last = ds.Timestamp
+		case <-time.After(2 * time.Second):
+			t.Fatal("no sample received")
+		}
+	}
+	sim.Disconnect()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, open := <-server.DataStream:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatal("data stream not closed after disconnect")
+		}
+	}
+}
+
+func TestStreamingServerUnknownDevice(t *testing.T) {
+	_, server := startSimulator(t, "A01B2C")
+	if err := ConnectE4(server, "FFFFFF", StreamGsr); err == nil {
+		t.Fatal("connected to unknown device")
+	}
+}
+
+func TestStreamingServerEvents(t *testing.T) {
+	sim, server := startSimulator(t, "A01B2C")
+	if err := ConnectE4(server, "A01B2C", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []string{"lost", "re-established"} {
+		if state == "lost" {
+			sim.LoseDevice("A01B2C")
+		} else {
+			sim.ReestablishDevice("A01B2C")
+		}
+		select {
+		case event := <-server.Events:
+			if event.Command != "connection" || len(event.Arguments) == 0 || event.Arguments[0] != state {
+				t.Fatalf("unexpected event %+v", event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s event received", state)
+		}
+	}
+}
+
+func TestStreamingServerRequests(t *testing.T) {
+	_, server := startSimulator(t, "A01B2C")
+	if err := server.DisconnectDevice(); err == nil {
+		t.Fatal("disconnected without device")
+	}
+	var re *ResponseError
+	if err := server.SubscribeStreams(StreamGsr); !errors.As(err, &re) || re.Command != "device_subscribe" {
+		t.Fatalf("subscribed without device: %v", err)
+	}
+	if err := server.ConnectDevice("A01B2C"); err != nil {
+		t.Fatal(err)
+	}
+	// Responses are routed while samples of all streams are streamed
+	if err := server.SubscribeStreams(allStreams); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			done <- server.SubscribeStreams(StreamAcc | StreamBvp)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Pause(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Pause(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.UnsubscribeStreams(allStreams); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.DisconnectDevice(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := DiscoverDevices(server); err != nil || !reflect.DeepEqual(ids, []string{"A01B2C"}) {
+		t.Fatalf("got discovered devices %v, %v", ids, err)
+	}
+	streams := map[StreamType]bool{}
+	for len(server.DataStream) > 0 {
+		streams[(<-server.DataStream).Stream] = true
+	}
+	for _, stream := range []StreamType{StreamAcc, StreamBvp, StreamGsr, StreamTmp} {
+		if !streams[stream] {
+			t.Errorf("no %s samples received", stream)
+		}
+	}
+}
+
+func TestStreamingServerTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The server accepts but never answers
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+	server := NewStreamingServer("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	server.Timeout = 100 * time.Millisecond
+	if err = server.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.ListDevices(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want timeout", err)
+	}
+	_ = server.Close()
+	if _, err = server.ListDevices(); err == nil {
+		t.Fatal("request on closed connection succeeded")
+	}
+}
+
+func TestStreamingServerUnansweredRequest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The server never answers the first request
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := 0; ; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if fields := strings.Fields(line); i > 0 && len(fields) > 1 {
+				_, _ = conn.Write([]byte("R device_subscribe " + fields[1] + " OK\n"))
+			}
+		}
+	}()
+	server := NewStreamingServer("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	server.Timeout = 100 * time.Millisecond
+	if err = server.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err = server.SubscribeStreams(StreamGsr); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want timeout", err)
+	}
+	if err = server.SubscribeStreams(StreamBvp); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.SubscribeStreams(StreamGsr); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,349 @@
+package empatica
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"viveSyncBroker/sensor"
+)
+
+// supervisor keeps a device connected. It reconnects with exponential backoff when the connection to the streaming
+// server ends, or when the device lost its Bluetooth connection and did not re-establish it within the grace period.
+type supervisor struct {
+	address    string
+	port       int
+	id         string
+	samples    chan sensor.Sample
+	status     chan sensor.Status
+	done       chan struct{}
+	once       sync.Once
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	grace      time.Duration
+	timeout    time.Duration
+	batteryLow float64
+	clock      *Clock
+	mu         sync.Mutex
+	streams    StreamType
+	subscribed StreamType
+	server     *StreamingServer
+	changed    chan struct{}
+}
+
+// newSupervisor reads the supervision configuration:
+//
+//	E4_RECONNECT_MIN:  first delay between connection attempts, default 1s
+//	E4_RECONNECT_MAX:  maximum delay between connection attempts, default 30s
+//	E4_RECONNECT_GRACE: time a device may take to re-establish a lost connection on its own, default 10s
+//	E4_REQUEST_TIMEOUT: time the streaming server has to answer a request, default 5s
+//	E4_CLOCK_WINDOW:    window of the clock offset estimation, default 60s
+//	E4_BATTERY_LOW:    battery level below which a warning is emitted, default 0.1
+func newSupervisor(address string, port int, id string, streams StreamType) *supervisor {
+	sv := &supervisor{
+		address:    address,
+		port:       port,
+		id:         id,
+		streams:    streams,
+		minBackoff: DurationEnv("E4_RECONNECT_MIN", time.Second),
+		maxBackoff: DurationEnv("E4_RECONNECT_MAX", 30*time.Second),
+		grace:      DurationEnv("E4_RECONNECT_GRACE", 10*time.Second),
+		timeout:    DurationEnv("E4_REQUEST_TIMEOUT", DefaultTimeout),
+		clock:      NewClock(DurationEnv("E4_CLOCK_WINDOW", time.Minute)),
+		batteryLow: 0.1,
+		samples:    make(chan sensor.Sample, 1024),
+		status:     make(chan sensor.Status, 16),
+		done:       make(chan struct{}),
+		changed:    make(chan struct{}, 1),
+	}
+	if s := os.Getenv("E4_BATTERY_LOW"); s != "" {
+		low, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			fmt.Printf("invalid E4_BATTERY_LOW '%s'\n", s)
+		} else {
+			sv.batteryLow = low
+		}
+	}
+	if id != "" {
+		updateDevice(id, func(d *DeviceInfo) {
+			d.Streams = streams.Strings()
+		})
+	}
+	return sv
+}
+
+// DurationEnv parses a positive duration from the environment. Missing or invalid values give the fallback.
+func DurationEnv(name string, fallback time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		fmt.Printf("invalid %s '%s'\n", name, s)
+		return fallback
+	}
+	return d
+}
+
+// run connects the device, records its samples until the connection ends and reconnects. The delay between attempts
+// doubles up to the maximum and starts over after a successful connection. A server connection may be given for the
+// first attempt. It ends when the supervisor is closed.
+func (sv *supervisor) run(server *StreamingServer) {
+	defer close(sv.status)
+	defer close(sv.samples)
+	go sv.applyStreams()
+	backoff := sv.minBackoff
+	attempt := 0
+	for {
+		connected, err := sv.connect(server)
+		server = nil
+		if connected {
+			backoff = sv.minBackoff
+			attempt = 0
+		}
+		if sv.closed() {
+			return
+		}
+		attempt++
+		sv.emit(sensor.Status{Status: sensor.StatusReconnecting, Detail: err.Error(), Attempt: attempt})
+		select {
+		case <-sv.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > sv.maxBackoff {
+			backoff = sv.maxBackoff
+		}
+	}
+}
+
+// connect connects the device on a new or the given server connection and records its samples until the connection
+// ends. Without a device, the first device of the streaming server is taken. It reports whether the device was
+// connected.
+func (sv *supervisor) connect(server *StreamingServer) (bool, error) {
+	if server == nil {
+		server = NewStreamingServer(sv.address, sv.port)
+		server.Timeout = sv.timeout
+		if err := server.Connect(); err != nil {
+			return false, err
+		}
+	}
+	id := sv.device()
+	if id == "" {
+		var err error
+		if id, err = sv.discover(server); err != nil {
+			_ = server.Close()
+			return false, err
+		}
+	}
+	sv.mu.Lock()
+	streams := sv.streams
+	sv.mu.Unlock()
+	if err := ConnectE4(server, id, streams); err != nil {
+		_ = server.Close()
+		return false, err
+	}
+	sv.mu.Lock()
+	sv.server = server
+	sv.subscribed = streams
+	sv.mu.Unlock()
+	// Apply stream changes made while connecting
+	sv.notify()
+	if sv.closed() {
+		_ = server.Close()
+	}
+	sv.emit(sensor.Status{Status: sensor.StatusConnected})
+	watched := make(chan struct{})
+	go func() {
+		sv.watch(server)
+		close(watched)
+	}()
+	sv.record(server)
+	<-watched
+	sv.mu.Lock()
+	sv.server = nil
+	sv.mu.Unlock()
+	return true, fmt.Errorf("connection to the streaming server ended")
+}
+
+// discover takes the first device of the streaming server as the device of the supervisor.
+func (sv *supervisor) discover(server *StreamingServer) (string, error) {
+	available, err := ListDevices(server)
+	if err != nil {
+		return "", err
+	}
+	if len(available) == 0 {
+		return "", fmt.Errorf("no device available")
+	}
+	sv.mu.Lock()
+	sv.id = available[0]
+	streams := sv.streams
+	sv.mu.Unlock()
+	updateDevice(available[0], func(d *DeviceInfo) {
+		d.Streams = streams.Strings()
+	})
+	fmt.Printf("Found device %s\n", available[0])
+	return available[0], nil
+}
+
+// device returns the ID of the device, or "" while no device was found.
+func (sv *supervisor) device() string {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.id
+}
+
+// close ends the connection of the device and stops reconnecting.
+func (sv *supervisor) close() error {
+	sv.once.Do(func() {
+		close(sv.done)
+	})
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.server != nil {
+		return sv.server.Close()
+	}
+	return nil
+}
+
+// closed reports whether the supervisor is closed.
+func (sv *supervisor) closed() bool {
+	select {
+	case <-sv.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// setStreams changes the streams of the device. If the device is connected, they are subscribed or unsubscribed in
+// the background. The changes are kept if the streaming server refuses them and are requested again on the next
+// change or connection.
+func (sv *supervisor) setStreams(enable StreamType, disable StreamType) error {
+	sv.mu.Lock()
+	sv.streams = (sv.streams | enable) &^ disable
+	id, streams := sv.id, sv.streams
+	sv.mu.Unlock()
+	if id != "" {
+		updateDevice(id, func(d *DeviceInfo) {
+			d.Streams = streams.Strings()
+		})
+	}
+	sv.notify()
+	return nil
+}
+
+// notify requests the streams to be applied, unless a request is already pending.
+func (sv *supervisor) notify() {
+	select {
+	case sv.changed <- struct{}{}:
+	default:
+	}
+}
+
+// applyStreams subscribes and unsubscribes the streams of the connected device after changes until the supervisor
+// is closed. The requests are made without holding the lock.
+func (sv *supervisor) applyStreams() {
+	for {
+		select {
+		case <-sv.done:
+			return
+		case <-sv.changed:
+		}
+		sv.mu.Lock()
+		id, server, streams, subscribed := sv.id, sv.server, sv.streams, sv.subscribed
+		sv.mu.Unlock()
+		if server == nil || streams == subscribed {
+			continue
+		}
+		err := server.SubscribeStreams(streams &^ subscribed)
+		if err2 := server.UnsubscribeStreams(subscribed &^ streams); err == nil {
+			err = err2
+		}
+		if err != nil {
+			fmt.Printf("Error: device %s: %+v\n", id, err)
+			continue
+		}
+		sv.mu.Lock()
+		if sv.server == server {
+			sv.subscribed = streams
+		}
+		sv.mu.Unlock()
+	}
+}
+
+// watch handles the connection events of a device. A device that lost its connection is reconnected on a new server
+// connection unless it re-establishes the connection within the grace period.
+func (sv *supervisor) watch(server *StreamingServer) {
+	var timer *time.Timer
+	for event := range server.Events {
+		if len(event.Arguments) == 0 {
+			continue
+		}
+		switch event.Arguments[0] {
+		case "lost":
+			sv.emit(sensor.Status{Status: sensor.StatusDeviceLost})
+			if timer == nil {
+				timer = time.AfterFunc(sv.grace, func() {
+					_ = server.Close()
+				})
+			}
+		case "re-established":
+			if timer != nil && timer.Stop() {
+				timer = nil
+			}
+			sv.emit(sensor.Status{Status: sensor.StatusConnected, Detail: "re-established"})
+		}
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// record passes the samples of a device connection until the connection ends. The samples are aligned to the
+// broker's clock. Battery samples below the threshold emit a warning, which is repeated once the level recovered.
+func (sv *supervisor) record(server *StreamingServer) {
+	warned := false
+	id := sv.device()
+	for ds := range server.DataStream {
+		ds.Device = id
+		sv.clock.Add(ds.Timestamp, ds.Received)
+		sv.clock.Align(&ds)
+		updateDevice(id, func(d *DeviceInfo) {
+			d.ClockOffset = ds.Aligned.Sub(ds.Timestamp).Seconds()
+			d.ClockUncertainty = ds.Uncertainty
+		})
+		sv.samples <- sensor.Sample{
+			Sensor:      id,
+			Channel:     ds.Stream.String(),
+			Timestamp:   ds.Timestamp,
+			Values:      ds.Values,
+			Aligned:     ds.Aligned,
+			Uncertainty: ds.Uncertainty,
+			Received:    ds.Received,
+		}
+		if ds.Stream == StreamBat && len(ds.Values) > 0 {
+			if level := ds.Values[0]; level < sv.batteryLow && !warned {
+				warned = true
+				sv.emit(sensor.Status{Status: sensor.StatusBatteryLow, Battery: level})
+			} else if level >= sv.batteryLow+0.05 {
+				warned = false
+			}
+		}
+	}
+}
+
+// emit updates the device registry and passes a status change.
+func (sv *supervisor) emit(st sensor.Status) {
+	st.Sensor = sv.device()
+	st.Time = time.Now()
+	if st.Status != sensor.StatusBatteryLow && st.Sensor != "" {
+		updateDevice(st.Sensor, func(d *DeviceInfo) {
+			d.Connected = st.Status == sensor.StatusConnected
+			d.Status = st.Status
+		})
+	}
+	sv.status <- st
+}
@@ -0,0 +1,494 @@
+package inspect
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+// BIDSVersion is the version of the BIDS specification the export follows.
+const BIDSVersion = "1.8.0"
+
+var nonAlphanumeric = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// BIDSOptions configures a BIDS export. Labels are reduced to letters and digits as BIDS requires. Events are the
+// commands written to the events file, in addition to phase changes and Empatica tags.
+type BIDSOptions struct {
+	Dataset   string
+	Subject   string
+	Session   string
+	Task      string
+	Events    []string
+	Reference time.Time
+	Generator string
+	Version   string
+}
+
+// physioStream describes the columns of an Empatica stream in a physio file. Streams without sampling frequency are
+// irregular, e.g. heart rate values derived from detected beats.
+type physioStream struct {
+	columns   []string
+	units     []string
+	frequency float64
+	desc      string
+}
+
+// physioStreams maps the Empatica stream names to their physio file layout.
+var physioStreams = map[string]physioStream{
+	"acc": {[]string{"accel_x", "accel_y", "accel_z"}, []string{"1/64 g", "1/64 g", "1/64 g"}, 32, "3-axis acceleration"},
+	"bvp": {[]string{"bvp"}, []string{"a.u."}, 64, "blood volume pulse"},
+	"gsr": {[]string{"eda"}, []string{"uS"}, 4, "electrodermal activity"},
+	"tmp": {[]string{"temperature"}, []string{"degC"}, 4, "peripheral skin temperature"},
+	"ibi": {[]string{"ibi"}, []string{"s"}, 0, "inter-beat interval"},
+	"hr":  {[]string{"heart_rate"}, []string{"bpm"}, 0, "heart rate derived from inter-beat intervals"},
+	"bat": {[]string{"battery"}, []string{"fraction"}, 0, "battery level"},
+}
+
+// bidsSample is a sample of a physio recording.
+type bidsSample struct {
+	time   time.Time
+	values []float64
+}
+
+// bidsEvent is a row of the events file.
+type bidsEvent struct {
+	onset     time.Time
+	duration  float64
+	trialType string
+	value     string
+	source    string
+	command   string
+	phase     string
+	trial     string
+	condition string
+}
+
+// ExportBIDS writes entries of a recording as BIDS-style dataset into a folder: one gzipped physio TSV with JSON
+// sidecar per Empatica stream and device, an events file from phase changes, Empatica tags and the event commands, a
+// behavioral file with all other commands, the dataset description and the participants list. Onsets are seconds
+// since the reference time, by default the first entry. It returns the written files.
+func ExportBIDS(folder string, entries []Entry, opts BIDSOptions) ([]string, error) {
+	if opts.Subject = nonAlphanumeric.ReplaceAllString(opts.Subject, ""); opts.Subject == "" {
+		return nil, fmt.Errorf("missing subject label")
+	}
+	opts.Session = nonAlphanumeric.ReplaceAllString(opts.Session, "")
+	if opts.Task = nonAlphanumeric.ReplaceAllString(opts.Task, ""); opts.Task == "" {
+		opts.Task = "vr"
+	}
+	if opts.Reference.IsZero() {
+		for _, e := range entries {
+			if !e.Timestamp.IsZero() && (opts.Reference.IsZero() || e.Timestamp.Before(opts.Reference)) {
+				opts.Reference = e.Timestamp
+			}
+		}
+	}
+	prefix := "sub-" + opts.Subject
+	dir := filepath.Join(folder, prefix)
+	if opts.Session != "" {
+		prefix += "_ses-" + opts.Session
+		dir = filepath.Join(dir, "ses-"+opts.Session)
+	}
+	prefix += "_task-" + opts.Task
+	dir = filepath.Join(dir, "beh")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var files []string
+	written := func(name string, err error) error {
+		if err == nil {
+			files = append(files, name)
+		}
+		return err
+	}
+
+	name := filepath.Join(folder, "dataset_description.json")
+	if !fileExists(name) {
+		if err := written(name, writeDatasetDescription(name, opts)); err != nil {
+			return files, err
+		}
+	}
+	name = filepath.Join(folder, "participants.tsv")
+	if err := written(name, addParticipant(name, "sub-"+opts.Subject)); err != nil {
+		return files, err
+	}
+
+	samples, commands, events := splitEntries(entries, opts.Events)
+	labels := recordingLabels(samples)
+	for _, key := range sortedStreamKeys(samples) {
+		base := filepath.Join(dir, prefix+"_recording-"+labels[key]+"_physio")
+		stream := physioStreams[key.stream]
+		start, err := writePhysio(base+".tsv.gz", samples[key], len(stream.columns), opts.Reference)
+		if err = written(base+".tsv.gz", err); err != nil {
+			return files, err
+		}
+		sidecar := map[string]interface{}{
+			"SamplingFrequency":      "n/a",
+			"StartTime":              start,
+			"Columns":                append([]string{"onset"}, stream.columns...),
+			"Manufacturer":           "Empatica",
+			"ManufacturersModelName": "E4",
+			"DeviceSerialNumber":     key.device,
+			"RecordingDescription":   stream.desc,
+			"onset": map[string]string{
+				"Description": "Device time of the sample, aligned to the broker clock, relative to the events file",
+				"Units":       "s",
+			},
+		}
+		if stream.frequency > 0 {
+			sidecar["SamplingFrequency"] = stream.frequency
+		}
+		for i, column := range stream.columns {
+			sidecar[column] = map[string]string{"Units": stream.units[i]}
+		}
+		if err = written(base+".json", writeJSON(base+".json", sidecar)); err != nil {
+			return files, err
+		}
+	}
+
+	base := filepath.Join(dir, prefix+"_events")
+	if err := written(base+".tsv", writeEvents(base+".tsv", events, opts.Reference)); err != nil {
+		return files, err
+	}
+	if err := written(base+".json", writeJSON(base+".json", eventsSidecar)); err != nil {
+		return files, err
+	}
+	base = filepath.Join(dir, prefix+"_beh")
+	if err := written(base+".tsv", writeCommands(base+".tsv", commands, opts.Reference)); err != nil {
+		return files, err
+	}
+	if err := written(base+".json", writeJSON(base+".json", behSidecar)); err != nil {
+		return files, err
+	}
+	return files, nil
+}
+
+// streamKey identifies the samples of one Empatica stream of one device.
+type streamKey struct {
+	device string
+	stream string
+}
+
+// splitEntries sorts entries into Empatica samples, commands and events. Phase changes are events that last until the
+// next phase change or the end of the recording; every event is annotated with the phase, trial and condition of the
+// phase change preceding it.
+func splitEntries(entries []Entry, eventCommands []string) (map[streamKey][]bidsSample, []Entry, []bidsEvent) {
+	samples := make(map[streamKey][]bidsSample)
+	var commands []Entry
+	var events []bidsEvent
+	var end time.Time
+	lastPhase := -1
+	for _, e := range entries {
+		if e.Timestamp.After(end) {
+			end = e.Timestamp
+		}
+		var event *bidsEvent
+		switch {
+		case e.Command == "e4_tag":
+			t, _ := e4Sample(e)
+			event = &bidsEvent{onset: t, trialType: "tag"}
+		case strings.HasPrefix(e.Command, "e4_"):
+			stream := strings.TrimPrefix(e.Command, "e4_")
+			if _, known := physioStreams[stream]; known {
+				key := streamKey{strings.TrimPrefix(e.Source, "e4:"), stream}
+				t, values := e4Sample(e)
+				samples[key] = append(samples[key], bidsSample{t, values})
+			}
+		case e.Command == "phase":
+			commands = append(commands, e)
+			state, _ := e.Payload["to"].(map[string]interface{})
+			if lastPhase >= 0 {
+				events[lastPhase].duration = e.Timestamp.Sub(events[lastPhase].onset).Seconds()
+			}
+			lastPhase = len(events)
+			event = &bidsEvent{
+				onset:     e.Timestamp,
+				trialType: "phase",
+				value:     stateString(state, "phase"),
+				phase:     stateString(state, "phase"),
+				trial:     stateString(state, "trial"),
+				condition: stateString(state, "condition"),
+			}
+		default:
+			commands = append(commands, e)
+			if len(eventCommands) > 0 && persistence.Selects(eventCommands, e.Command) {
+				trialType, value := eventValue(e)
+				event = &bidsEvent{onset: e.Timestamp, trialType: trialType, value: value}
+			}
+		}
+		if event == nil {
+			continue
+		}
+		event.source = e.Source
+		event.command = e.Command
+		events = append(events, *event)
+	}
+	if lastPhase >= 0 {
+		events[lastPhase].duration = end.Sub(events[lastPhase].onset).Seconds()
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].onset.Before(events[j].onset)
+	})
+	var phase bidsEvent
+	for i := range events {
+		if events[i].command == "phase" {
+			phase = events[i]
+			continue
+		}
+		events[i].phase, events[i].trial, events[i].condition = phase.phase, phase.trial, phase.condition
+	}
+	return samples, commands, events
+}
+
+// e4Sample returns the device timestamp, aligned to the broker's clock if recorded, and values of an Empatica entry.
+// Entries without device timestamp use the broker's receive time.
+func e4Sample(e Entry) (time.Time, []float64) {
+	t := e.Timestamp
+	for _, key := range []string{"aligned", "timestamp"} {
+		if ts, ok := e.Payload[key].(time.Time); ok && !ts.IsZero() {
+			t = ts
+			break
+		}
+	}
+	values, _ := e.Payload["values"].([]float64)
+	return t, values
+}
+
+// eventValue derives the trial type and value of an event command. The trial type is taken from the payload keys
+// "event", "marker", "label" or "name", falling back to the command; the value holds the remaining payload as json.
+func eventValue(e Entry) (string, string) {
+	trialType := e.Command
+	rest := make(map[string]interface{}, len(e.Payload))
+	for key, value := range e.Payload {
+		rest[key] = value
+	}
+	for _, key := range []string{"event", "marker", "label", "name"} {
+		if s, ok := rest[key].(string); ok && s != "" {
+			trialType = s
+			delete(rest, key)
+			break
+		}
+	}
+	if len(rest) == 0 {
+		return trialType, ""
+	}
+	data, _ := json.Marshal(rest)
+	return trialType, string(data)
+}
+
+// stateString returns a field of a study state as string.
+func stateString(state map[string]interface{}, key string) string {
+	switch v := state[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// recordingLabels names the physio recordings after their stream. Streams recorded by several devices are told
+// apart by the device id.
+func recordingLabels(samples map[streamKey][]bidsSample) map[streamKey]string {
+	devices := make(map[string]int)
+	for key := range samples {
+		devices[key.stream]++
+	}
+	labels := make(map[streamKey]string, len(samples))
+	for key := range samples {
+		labels[key] = key.stream
+		if devices[key.stream] > 1 {
+			labels[key] += nonAlphanumeric.ReplaceAllString(key.device, "")
+		}
+	}
+	return labels
+}
+
+// sortedStreamKeys returns the keys of the samples ordered by stream and device.
+func sortedStreamKeys(samples map[streamKey][]bidsSample) []streamKey {
+	keys := make([]streamKey, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stream != keys[j].stream {
+			return keys[i].stream < keys[j].stream
+		}
+		return keys[i].device < keys[j].device
+	})
+	return keys
+}
+
+// writePhysio writes samples ordered by time as gzipped TSV without header, as BIDS requires for physio files. The
+// first column is the onset of the sample, followed by a fixed number of values; missing values are written as "n/a".
+// It returns the onset of the first sample.
+func writePhysio(name string, samples []bidsSample, columns int, reference time.Time) (float64, error) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].time.Before(samples[j].time)
+	})
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	gz := gzip.NewWriter(f)
+	w := bufio.NewWriter(gz)
+	for _, s := range samples {
+		w.WriteString(seconds(s.time, reference))
+		for i := 0; i < columns; i++ {
+			w.WriteByte('\t')
+			if i < len(s.values) {
+				w.WriteString(strconv.FormatFloat(s.values[i], 'f', -1, 64))
+			} else {
+				w.WriteString("n/a")
+			}
+		}
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if len(samples) == 0 {
+		return 0, err
+	}
+	return math.Round(samples[0].time.Sub(reference).Seconds()*1e6) / 1e6, err
+}
+
+// writeEvents writes the events file.
+func writeEvents(name string, events []bidsEvent, reference time.Time) error {
+	return writeTSV(name, func(w io.Writer) {
+		fmt.Fprintln(w, "onset\tduration\ttrial_type\tvalue\tphase\ttrial\tcondition\tsource\tcommand")
+		for _, e := range events {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", seconds(e.onset, reference),
+				strconv.FormatFloat(e.duration, 'f', 6, 64), tsvValue(e.trialType), tsvValue(e.value),
+				tsvValue(e.phase), tsvValue(e.trial), tsvValue(e.condition), tsvValue(e.source), tsvValue(e.command))
+		}
+	})
+}
+
+// writeCommands writes all commands with their json payload.
+func writeCommands(name string, commands []Entry, reference time.Time) error {
+	return writeTSV(name, func(w io.Writer) {
+		fmt.Fprintln(w, "onset\tsource\tcommand\tdirection\tpayload")
+		for _, e := range commands {
+			payload := ""
+			if e.Payload != nil {
+				data, _ := json.Marshal(e.Payload)
+				payload = string(data)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", seconds(e.Timestamp, reference), tsvValue(e.Source),
+				tsvValue(e.Command), tsvValue(e.Direction), tsvValue(payload))
+		}
+	})
+}
+
+// writeTSV creates a file and writes its content through a buffer.
+func writeTSV(name string, content func(w io.Writer)) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	content(w)
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// seconds formats the time since the reference in seconds with microsecond precision.
+func seconds(t time.Time, reference time.Time) string {
+	return strconv.FormatFloat(t.Sub(reference).Seconds(), 'f', 6, 64)
+}
+
+// tsvValue replaces empty values by "n/a" and tabs and line breaks by spaces.
+func tsvValue(s string) string {
+	if s == "" {
+		return "n/a"
+	}
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+// writeJSON writes an indented json file.
+func writeJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// writeDatasetDescription writes the dataset description.
+func writeDatasetDescription(name string, opts BIDSOptions) error {
+	dataset := opts.Dataset
+	if dataset == "" {
+		dataset = filepath.Base(filepath.Dir(name))
+	}
+	generator := map[string]string{"Name": opts.Generator}
+	if opts.Version != "" {
+		generator["Version"] = opts.Version
+	}
+	return writeJSON(name, map[string]interface{}{
+		"Name":        dataset,
+		"BIDSVersion": BIDSVersion,
+		"DatasetType": "raw",
+		"GeneratedBy": []interface{}{generator},
+	})
+}
+
+// addParticipant adds a participant to the participants list unless it is already listed.
+func addParticipant(name string, participant string) error {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		data, err = []byte("participant_id\n"), nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.SplitN(line, "\t", 2)[0] == participant {
+			return nil
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return ioutil.WriteFile(name, append(data, participant+"\n"...), 0644)
+}
+
+// eventsSidecar describes the columns of the events file.
+var eventsSidecar = map[string]interface{}{
+	"onset":      map[string]string{"Description": "Broker receive time, or aligned time of Empatica tags", "Units": "s"},
+	"duration":   map[string]string{"Description": "Duration of phases, 0 for momentary events", "Units": "s"},
+	"trial_type": map[string]string{"Description": "Phase, Empatica tag, or the event, marker, label or name of a command"},
+	"value":      map[string]string{"Description": "Phase name, or the remaining command payload as json"},
+	"phase":      map[string]string{"Description": "Study phase at the time of the event"},
+	"trial":      map[string]string{"Description": "Trial within the study phase"},
+	"condition":  map[string]string{"Description": "Condition of the trial"},
+	"source":     map[string]string{"Description": "Client or device the event came from"},
+	"command":    map[string]string{"Description": "Broker command of the event"},
+}
+
+// behSidecar describes the columns of the behavioral file.
+var behSidecar = map[string]interface{}{
+	"onset":     map[string]string{"Description": "Broker receive time", "Units": "s"},
+	"source":    map[string]string{"Description": "Client the command came from"},
+	"command":   map[string]string{"Description": "Broker command"},
+	"direction": map[string]string{"Description": "in for received, out for sent commands"},
+	"payload":   map[string]string{"Description": "Command payload as json"},
+}
@@ -0,0 +1,116 @@
+package inspect
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// WriteCSV writes entries in the CSV persistence file format.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	records := make([]persistence.Record, len(entries))
+	for i, e := range entries {
+		records[i] = e.Record
+	}
+	return persistence.WriteCSV(w, records)
+}
+
+// WriteJSONL writes entries as JSON Lines, one object with the record columns and payload per line.
+func WriteJSONL(w io.Writer, entries []Entry) error {
+	encoder := json.NewEncoder(w)
+	for _, e := range entries {
+		err := encoder.Encode(struct {
+			Seq       uint64                 `json:"seq,omitempty"`
+			Source    string                 `json:"source"`
+			Command   string                 `json:"command"`
+			Topic     string                 `json:"topic,omitempty"`
+			Direction string                 `json:"direction,omitempty"`
+			Timestamp time.Time              `json:"timestamp"`
+			Payload   map[string]interface{} `json:"payload"`
+		}{e.Seq, e.Source, e.Command, e.Topic, e.Direction, e.Timestamp, e.Payload})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTables writes one CSV table per command into a folder. Each table has the columns source and timestamp,
+// followed by the flattened payload keys of all entries of that command. Payload keys that collide with the record
+// columns are prefixed with "payload.".
+func WriteTables(folder string, entries []Entry) ([]string, error) {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]map[string]string)
+	columns := make(map[string]map[string]bool)
+	order := make([]string, 0)
+	for _, e := range entries {
+		if _, found := groups[e.Command]; !found {
+			order = append(order, e.Command)
+			columns[e.Command] = make(map[string]bool)
+		}
+		row := make(map[string]string)
+		for key, value := range Flatten(e.Payload) {
+			if key == "source" || key == "timestamp" {
+				key = "payload." + key
+			}
+			row[key] = value
+			columns[e.Command][key] = true
+		}
+		row["source"] = e.Source
+		row["timestamp"] = e.Timestamp.Format(time.RFC3339Nano)
+		groups[e.Command] = append(groups[e.Command], row)
+	}
+	files := make([]string, 0, len(order))
+	for _, command := range order {
+		keys := make([]string, 0, len(columns[command]))
+		for key := range columns[command] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		header := append([]string{"source", "timestamp"}, keys...)
+		name := filepath.Join(folder, unsafeChars.ReplaceAllString(command, "_")+".csv")
+		if err := writeTable(name, header, groups[command]); err != nil {
+			return files, err
+		}
+		files = append(files, name)
+	}
+	return files, nil
+}
+
+// writeTable writes rows as CSV file with a header row.
+func writeTable(name string, header []string, rows []map[string]string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Comma = ';'
+	if err = writer.Write(header); err != nil {
+		return err
+	}
+	line := make([]string, len(header))
+	for _, row := range rows {
+		for i, column := range header {
+			line[i] = row[column]
+		}
+		if err = writer.Write(line); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
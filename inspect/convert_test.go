@@ -0,0 +1,46 @@
+package inspect
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+func TestWriteTablesCollidingKeys(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	entries := []Entry{{
+		Record:    persistence.Record{Source: "A01B2C", Command: "gsr"},
+		Timestamp: start,
+		Payload:   map[string]interface{}{"timestamp": "1709287200.5", "value": 0.25, "source": "e4"},
+	}}
+	folder := t.TempDir()
+	files, err := WriteTables(folder, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join(folder, "gsr.csv") {
+		t.Fatalf("unexpected files %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.Comma = ';'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"source", "timestamp", "payload.source", "payload.timestamp", "value"},
+		{"A01B2C", start.Format(time.RFC3339Nano), "e4", "1709287200.5", "0.25"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, got %v", expected, rows)
+	}
+}
@@ -0,0 +1,137 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+// Entry is a persisted record with its json data decoded. The Timestamp is the broker's receive time or, for files
+// written before it was recorded, the timestamp of the command itself.
+type Entry struct {
+	persistence.Record
+	Timestamp time.Time
+	Payload   map[string]interface{}
+}
+
+// Parse decodes persisted records. Empatica samples in files without command column are named after their stream,
+// e.g. "e4_gsr". Records that are not valid json are skipped.
+func Parse(records []persistence.Record) []Entry {
+	entries := make([]Entry, 0, len(records))
+	for _, rec := range records {
+		data := struct {
+			Command     string                 `json:"command"`
+			Device      string                 `json:"device"`
+			Stream      string                 `json:"stream"`
+			Timestamp   time.Time              `json:"timestamp"`
+			Payload     map[string]interface{} `json:"payload"`
+			Values      []float64              `json:"values"`
+			Aligned     time.Time              `json:"aligned"`
+			Uncertainty float64                `json:"uncertainty"`
+		}{}
+		if err := json.Unmarshal(rec.Data, &data); err != nil {
+			continue
+		}
+		e := Entry{
+			Record:    rec,
+			Timestamp: rec.Time,
+			Payload:   data.Payload,
+		}
+		if e.Command == "" {
+			e.Command = data.Command
+		}
+		if e.Timestamp.IsZero() {
+			e.Timestamp = data.Timestamp
+		}
+		if data.Stream != "" {
+			if e.Command == "" {
+				e.Command = "e4_" + data.Stream
+			}
+			e.Payload = map[string]interface{}{
+				"timestamp": data.Timestamp,
+				"values":    data.Values,
+			}
+			if data.Device != "" {
+				e.Payload["device"] = data.Device
+			}
+			if !data.Aligned.IsZero() {
+				e.Payload["aligned"] = data.Aligned
+				e.Payload["uncertainty"] = data.Uncertainty
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Filter selects entries by source, command and time range. Sources and commands are compared case-insensitively,
+// empty lists and zero times match everything.
+type Filter struct {
+	Sources  []string
+	Commands []string
+	From     time.Time
+	To       time.Time
+}
+
+// Apply returns the entries passing the Filter.
+func (f Filter) Apply(entries []Entry) []Entry {
+	result := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		if !persistence.Selects(f.Sources, e.Source) || !persistence.Selects(f.Commands, e.Command) {
+			continue
+		}
+		if !f.From.IsZero() && e.Timestamp.Before(f.From) {
+			continue
+		}
+		if !f.To.IsZero() && e.Timestamp.After(f.To) {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// ParseTime parses a time range bound, which is either an RFC 3339 timestamp or a duration like "90s" relative to
+// a reference time, e.g. the start of a recording.
+func ParseTime(value string, reference time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither a timestamp nor a duration", value)
+	}
+	return reference.Add(d), nil
+}
+
+// Flatten converts nested payload objects into a flat map with dot-separated keys, e.g. {"a":{"b":1}} to {"a.b":1}.
+// Arrays are kept as json.
+func Flatten(payload map[string]interface{}) map[string]string {
+	result := make(map[string]string)
+	flatten("", payload, result)
+	return result
+}
+
+// flatten adds the values of a nested object with a key prefix to a flat map.
+func flatten(prefix string, v map[string]interface{}, result map[string]string) {
+	for key, value := range v {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flatten(key, value, result)
+		case string:
+			result[key] = value
+		case nil:
+			result[key] = ""
+		default:
+			data, _ := json.Marshal(value)
+			result[key] = string(data)
+		}
+	}
+}
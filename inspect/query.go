@@ -0,0 +1,223 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+// Condition matches entries by a payload value. The Path is dot-separated, array elements are addressed by their
+// index, e.g. "values.0". Without Value, the Path only has to exist.
+type Condition struct {
+	Path     string
+	Value    string
+	HasValue bool
+}
+
+// ParseCondition parses a condition "path" or "path=value".
+func ParseCondition(s string) Condition {
+	if i := strings.Index(s, "="); i >= 0 {
+		return Condition{Path: s[:i], Value: s[i+1:], HasValue: true}
+	}
+	return Condition{Path: s}
+}
+
+// Match reports if an entry's payload meets the Condition.
+func (c Condition) Match(e Entry) bool {
+	v, found := Lookup(e.Payload, c.Path)
+	if !found {
+		return false
+	}
+	return !c.HasValue || FormatValue(v) == c.Value
+}
+
+// Query selects entries by the Filter and all its Conditions.
+type Query struct {
+	Filter
+	Conditions []Condition
+}
+
+// Match reports if an entry passes the Query.
+func (q Query) Match(e Entry) bool {
+	if !persistence.Selects(q.Sources, e.Source) || !persistence.Selects(q.Commands, e.Command) {
+		return false
+	}
+	if !q.From.IsZero() && e.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Timestamp.After(q.To) {
+		return false
+	}
+	for _, c := range q.Conditions {
+		if !c.Match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Run reads the files one after another and passes the matching entries to emit, so results are available before
+// all files are read. Files that cannot be read completely, e.g. the ones currently written, contribute the records
+// read so far; the first such error is returned after all files are read. Truncated encrypted files are no error.
+func (q Query) Run(files []string, emit func(e Entry) error) error {
+	var readErr error
+	for _, file := range files {
+		records, err := persistence.ReadFile(file)
+		if err != nil && err != persistence.ErrTruncated && readErr == nil {
+			readErr = fmt.Errorf("%s: %v", file, err)
+		}
+		for _, e := range Parse(records) {
+			if !q.Match(e) {
+				continue
+			}
+			if err = emit(e); err != nil {
+				return err
+			}
+		}
+	}
+	return readErr
+}
+
+// Lookup returns the value at a dot-separated path within a payload.
+func Lookup(payload map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, found := node[key]
+			if !found {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		case []float64:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// FormatValue formats a payload value like Flatten does: strings as they are, nil as empty string and everything else
+// as json.
+func FormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// Aggregate summarizes the entries of a group. The first and last value are taken from the earliest and latest
+// entries having the aggregated payload path.
+type Aggregate struct {
+	Source     string      `json:"source,omitempty"`
+	Command    string      `json:"command,omitempty"`
+	Count      int         `json:"count"`
+	First      time.Time   `json:"first"`
+	Last       time.Time   `json:"last"`
+	Rate       float64     `json:"rate"`
+	FirstValue interface{} `json:"first_value,omitempty"`
+	LastValue  interface{} `json:"last_value,omitempty"`
+	firstValue time.Time
+	lastValue  time.Time
+	hasValue   bool
+}
+
+// Aggregator groups entries by source and/or command and aggregates each group.
+type Aggregator struct {
+	bySource  bool
+	byCommand bool
+	value     string
+	groups    map[[2]string]*Aggregate
+}
+
+// NewAggregator creates an Aggregator grouping by the given columns, "source" and "command", and taking first and
+// last values from a payload path. Without columns, all entries form one group.
+func NewAggregator(by []string, value string) (*Aggregator, error) {
+	a := &Aggregator{value: value, groups: make(map[[2]string]*Aggregate)}
+	for _, column := range by {
+		switch column {
+		case "source":
+			a.bySource = true
+		case "command":
+			a.byCommand = true
+		default:
+			return nil, fmt.Errorf("cannot group by '%s', only by source and command", column)
+		}
+	}
+	return a, nil
+}
+
+// Add adds an entry to its group.
+func (a *Aggregator) Add(e Entry) {
+	key := [2]string{}
+	if a.bySource {
+		key[0] = e.Source
+	}
+	if a.byCommand {
+		key[1] = e.Command
+	}
+	g, found := a.groups[key]
+	if !found {
+		g = &Aggregate{Source: key[0], Command: key[1], First: e.Timestamp, Last: e.Timestamp}
+		a.groups[key] = g
+	}
+	g.Count++
+	if e.Timestamp.Before(g.First) {
+		g.First = e.Timestamp
+	}
+	if e.Timestamp.After(g.Last) {
+		g.Last = e.Timestamp
+	}
+	if a.value == "" {
+		return
+	}
+	value, found := Lookup(e.Payload, a.value)
+	if !found {
+		return
+	}
+	if !g.hasValue || e.Timestamp.Before(g.firstValue) {
+		g.FirstValue, g.firstValue = value, e.Timestamp
+	}
+	if !g.hasValue || !e.Timestamp.Before(g.lastValue) {
+		g.LastValue, g.lastValue = value, e.Timestamp
+	}
+	g.hasValue = true
+}
+
+// Results returns the aggregates ordered by source and command, with their rates over the time between first and last
+// entry.
+func (a *Aggregator) Results() []Aggregate {
+	results := make([]Aggregate, 0, len(a.groups))
+	for _, g := range a.groups {
+		if d := g.Last.Sub(g.First); d > 0 {
+			g.Rate = float64(g.Count) / d.Seconds()
+		}
+		results = append(results, *g)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Source != results[j].Source {
+			return results[i].Source < results[j].Source
+		}
+		return results[i].Command < results[j].Command
+	})
+	return results
+}
@@ -0,0 +1,117 @@
+package inspect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"viveSyncBroker/persistence"
+)
+
+// preferredExtensions orders the backend formats by how completely they keep records. When a segment was written to
+// several backends, only the file of the first format found is read.
+var preferredExtensions = []string{".binlog", ".jsonl", ".db", ".csv"}
+
+// LoadSession reads the records of a persistence file or of all segments of a session directory, ordered by sequence
+// number. The session manifest is returned if there is one next to the files.
+func LoadSession(path string) ([]Entry, *persistence.Session, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	folder := path
+	files := []string{path}
+	if !info.IsDir() {
+		folder = filepath.Dir(path)
+	} else if files, err = segmentFiles(path); err != nil {
+		return nil, nil, err
+	}
+	var manifest *persistence.Session
+	if name := persistence.ManifestPath(folder); name != "" {
+		if manifest, err = persistence.ReadManifest(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	var records []persistence.Record
+	for _, file := range files {
+		recs, err := persistence.ReadFile(file)
+		if err != nil {
+			return nil, manifest, err
+		}
+		records = append(records, recs...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	return Parse(records), manifest, nil
+}
+
+// Files returns a persistence file itself, or one file per segment of a folder and all its subfolders, e.g. session
+// directories.
+func Files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		found, err := segmentFiles(name)
+		files = append(files, found...)
+		return err
+	})
+	return files, err
+}
+
+// segmentFiles returns one persistence file per segment of a directory.
+func segmentFiles(folder string) ([]string, error) {
+	infos, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	chosen := make(map[string]string)
+	var segments []string
+	for _, info := range infos {
+		name := filepath.Join(folder, info.Name())
+		if info.IsDir() || info.Name() == persistence.ManifestName || !persistence.IsPersistenceFile(name) {
+			continue
+		}
+		segment := persistence.SegmentName(name)
+		current, found := chosen[segment]
+		if !found {
+			segments = append(segments, segment)
+		}
+		if !found || formatRank(name) < formatRank(current) {
+			chosen[segment] = name
+		}
+	}
+	sort.Strings(segments)
+	files := make([]string, len(segments))
+	for i, segment := range segments {
+		files[i] = chosen[segment]
+	}
+	return files, nil
+}
+
+// formatRank returns the position of a file's backend format in preferredExtensions.
+func formatRank(file string) int {
+	extensions := strings.TrimPrefix(filepath.Base(file), persistence.SegmentName(file))
+	for i, ext := range preferredExtensions {
+		if strings.HasPrefix(extensions, ext) {
+			return i
+		}
+	}
+	return len(preferredExtensions)
+}
+
+// fileExists reports if a file exists.
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,106 @@
+package inspect
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Gap is a period without any entries.
+type Gap struct {
+	From     time.Time
+	To       time.Time
+	Duration time.Duration
+}
+
+// Summary describes a recording.
+type Summary struct {
+	Entries  int
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	Rate     float64
+	Clients  map[string]int
+	Commands map[string]int
+	Gaps     []Gap
+}
+
+// Summarize creates a Summary of entries. Periods without entries longer than gap are reported as Gap.
+func Summarize(entries []Entry, gap time.Duration) Summary {
+	s := Summary{
+		Entries:  len(entries),
+		Clients:  make(map[string]int),
+		Commands: make(map[string]int),
+	}
+	times := make([]time.Time, 0, len(entries))
+	for _, e := range entries {
+		s.Clients[e.Source]++
+		s.Commands[e.Command]++
+		if !e.Timestamp.IsZero() {
+			times = append(times, e.Timestamp)
+		}
+	}
+	if len(times) == 0 {
+		return s
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	s.Start = times[0]
+	s.End = times[len(times)-1]
+	s.Duration = s.End.Sub(s.Start)
+	if s.Duration > 0 {
+		s.Rate = float64(len(times)) / s.Duration.Seconds()
+	}
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); gap > 0 && d > gap {
+			s.Gaps = append(s.Gaps, Gap{From: times[i-1], To: times[i], Duration: d})
+		}
+	}
+	return s
+}
+
+// Print writes a human-readable Summary.
+func (s Summary) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Entries:\t%d\n", s.Entries)
+	fmt.Fprintf(tw, "Start:\t%s\n", s.Start.Format(time.RFC3339Nano))
+	fmt.Fprintf(tw, "End:\t%s\n", s.End.Format(time.RFC3339Nano))
+	fmt.Fprintf(tw, "Duration:\t%s\n", s.Duration)
+	fmt.Fprintf(tw, "Rate:\t%.2f/s\n", s.Rate)
+	fmt.Fprintf(tw, "\nSource\tEntries\tRate\n")
+	for _, key := range sortedKeys(s.Clients) {
+		fmt.Fprintf(tw, "%s\t%d\t%.2f/s\n", key, s.Clients[key], s.rate(s.Clients[key]))
+	}
+	fmt.Fprintf(tw, "\nCommand\tEntries\tRate\n")
+	for _, key := range sortedKeys(s.Commands) {
+		fmt.Fprintf(tw, "%s\t%d\t%.2f/s\n", key, s.Commands[key], s.rate(s.Commands[key]))
+	}
+	if len(s.Gaps) > 0 {
+		fmt.Fprintf(tw, "\nGap from\tGap to\tDuration\n")
+		for _, g := range s.Gaps {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", g.From.Format(time.RFC3339Nano), g.To.Format(time.RFC3339Nano), g.Duration)
+		}
+	}
+	_ = tw.Flush()
+}
+
+// rate returns the rate of a number of entries over the Summary's duration.
+func (s Summary) rate(n int) float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(n) / s.Duration.Seconds()
+}
+
+// sortedKeys returns the keys of a map in ascending order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
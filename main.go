@@ -6,30 +6,51 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"viveSyncBroker/empatica"
 )
 
 var (
 	netmgr *NetworkMgr
+	// shutdown receives the signals, and shutdown requests, that end the broker
+	shutdown = make(chan os.Signal, 1)
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		// Offline subcommands work without the broker configuration, but use its keys, e.g. PERSIST_ENCRYPTION_*
+		if err := godotenv.Load(".env"); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatal(err)
 	}
 	setupLogger()
+	setupSessions()
 	netmgr = NewNetworkMgr()
-	if os.Getenv("E4_ACTIVE") == "true" {
-		empatica.Setup(netmgr.Persist)
+	setupMarkers()
+	if err := setupSensors(netmgr.Commands); err != nil {
+		log.Fatal(err)
 	}
 	RegisterCommands()
+	if err := setupCounterbalance(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupStudy(netmgr.Commands); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupReplay(netmgr.Commands); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupQueryServer(); err != nil {
+		log.Fatal(err)
+	}
 	if err := netmgr.Connect(); err != nil {
 		log.Fatal(err)
 	}
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
-	<-signals
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
+	<-shutdown
 	netmgr.Close()
 	<-netmgr.ShutdownCompleted
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"viveSyncBroker/persistence"
+	"viveSyncBroker/sensor"
+)
+
+// markerTopics are the topics markers are published on for analysis clients.
+var markerTopics = []string{"markers"}
+
+// setupMarkers reads MARKER_TOPICS, the comma separated topics markers are published on, default "markers".
+func setupMarkers() {
+	if topics := splitList(os.Getenv("MARKER_TOPICS")); len(topics) > 0 {
+		markerTopics = topics
+	}
+}
+
+// MarkerCommand is the Command for "marker". Clients send it at stimulus onsets, naming the event in "marker", e.g.
+// {"marker":"stimulus_on","stimulus":"face_03"}. The time the broker received it is the time of the marker: the marker
+// is persisted, published on the marker topics and recorded with the samples of every sensor, and the response holds
+// the time.
+func MarkerCommand(com *Command, ch *CommandHandler) error {
+	if marker, _ := com.Payload["marker"].(string); marker == "" {
+		ch.RespondError(com, fmt.Errorf("missing marker"))
+		return nil
+	}
+	ch.Persist(com, strings.Join(markerTopics, ","))
+	publishMarker(ch, com)
+	marker := make(map[string]interface{}, len(com.Payload)+1)
+	for key, value := range com.Payload {
+		marker[key] = value
+	}
+	if com.Source != nil {
+		marker["source"] = com.Source.String()
+	}
+	for _, a := range sensors {
+		recordMarker(ch, a, com.Received, marker)
+	}
+	com.Payload["response"] = map[string]interface{}{
+		"time": com.Received,
+	}
+	ch.Respond(com)
+	return nil
+}
+
+// recordMarker persists a marker of a client as "<kind>_marker" record of a sensor, e.g. "e4_marker", at the broker
+// time it was received.
+func recordMarker(ch *CommandHandler, a sensor.Adapter, t time.Time, marker map[string]interface{}) {
+	payload := make(map[string]interface{}, len(marker)+1)
+	for key, value := range marker {
+		payload[key] = value
+	}
+	payload["device"] = a.Name()
+	data, err := json.Marshal(map[string]interface{}{
+		"command":   a.Kind() + "_marker",
+		"timestamp": t,
+		"payload":   payload,
+	})
+	if err != nil {
+		fmt.Printf("Error: %+v\n", err)
+	}
+	ch.nm.Persist.AddRecord(persistence.Record{
+		Time:      t,
+		Source:    a.Kind() + ":" + a.Name(),
+		Command:   a.Kind() + "_marker",
+		Topic:     a.Kind(),
+		Direction: persistence.DirectionIn,
+		Data:      data,
+	})
+}
+
+// tagMarker broadcasts a sample of a "tag" channel, e.g. a press on the tag button of an Empatica device, as "marker"
+// Command named "<kind>_tag", stamped with the aligned time. Every client receives broadcasts, so it is not published
+// on the marker topics as well.
+func tagMarker(ch *CommandHandler, a sensor.Adapter, s sensor.Sample) {
+	com := NewCommand("marker", map[string]interface{}{
+		"marker": a.Kind() + "_tag",
+		"device": s.Sensor,
+	})
+	t := s.Time()
+	com.Timestamp = &t
+	ch.Broadcast(com)
+}
+
+// publishMarker sends a marker to the clients subscribed to the marker topics.
+func publishMarker(ch *CommandHandler, com *Command) {
+	data := com.ToBytes()
+	for _, topic := range markerTopics {
+		ch.nm.Pubsub.Publish(topic, data)
+	}
+}
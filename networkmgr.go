@@ -81,7 +81,7 @@ func (nm *NetworkMgr) Listen() {
 		nm.Pubsub.Subscribe(PubSubTopicBasic, addr)
 
 		if err = nm.Commands.Handle(cmd); err != nil {
-			log.Fatalln(err)
+			log.Println(err)
 		}
 	}
 }
@@ -93,7 +93,7 @@ func (nm *NetworkMgr) safeIterateCb(client *UdpClient) {
 func (nm *NetworkMgr) Publish() {
 	for !nm.Pubsub.closed {
 		// Try to Lock to wait if no subs here
-		for _, clients := range nm.Pubsub.subs {
+		for _, clients := range nm.Pubsub.topics() {
 			clients.Range(func(k interface{}, c interface{}) bool {
 				client := c.(*UdpClient)
 				select {
@@ -111,8 +111,10 @@ func (nm *NetworkMgr) Publish() {
 	}
 }
 
+// Close stops the networking and drains the persistence before signalling ShutdownCompleted.
 func (nm *NetworkMgr) Close() {
 	nm.Pubsub.Close()
 	_ = nm.conn.Close()
+	nm.Persist.Close()
 	nm.ShutdownCompleted <- true
 }
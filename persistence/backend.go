@@ -0,0 +1,146 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DirectionIn marks records received by the broker from clients or sensors.
+	DirectionIn = "in"
+	// DirectionOut marks records created and sent by the broker itself.
+	DirectionOut = "out"
+)
+
+// Record is a persisted entry. Seq, Time and Monotonic are set by the PersistenceHandler if not provided.
+type Record struct {
+	// Seq numbers the records of a broker run in the order they are persisted.
+	Seq uint64
+	// Time is the wall clock time the broker received or created the entry.
+	Time time.Time
+	// Monotonic is the time since the broker start on the monotonic clock.
+	Monotonic time.Duration
+	// Source identifies the sender, e.g. a client address, "broker" or an Empatica device.
+	Source    string
+	Command   string
+	Topic     string
+	Direction string
+	Data      []byte
+	// Hash chains the record to the previous record of its file, see chainHash.
+	Hash string
+}
+
+// columns are the names of the Record fields in tabular formats.
+var columns = []string{"seq", "time", "monotonic_ns", "source", "command", "topic", "direction", "data", "hash"}
+
+// commandName extracts the command name from json data.
+func commandName(data []byte) string {
+	header := struct {
+		Command string `json:"command"`
+	}{}
+	_ = json.Unmarshal(data, &header)
+	return header.Command
+}
+
+// Selects reports if a filter list selects a value, e.g. a source or command. An empty list selects every value,
+// otherwise values are compared case-insensitively.
+func Selects(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backend writes records to a file in a specific storage format.
+type Backend interface {
+	// Extension returns the file extension of the format, including the leading dot.
+	Extension() string
+	// Open creates a new file and directs subsequent writes to it.
+	Open(name string) error
+	// Write adds a record to the file.
+	Write(rec Record) error
+	// Flush writes buffered records to the file.
+	Flush() error
+	// Sync flushes and commits the file's content to stable storage.
+	Sync() error
+	// Close syncs and closes the file.
+	Close() error
+}
+
+// backendFormat describes a storage format by its constructor, its reader and its recovery, which truncates a torn
+// last record left behind by a crash and returns the number of removed bytes.
+type backendFormat struct {
+	create  func() Backend
+	read    func(path string) ([]Record, error)
+	recover func(path string) (int64, error)
+}
+
+var formats = map[string]backendFormat{
+	"csv":    {func() Backend { return &csvBackend{} }, readCSV, recoverLines},
+	"jsonl":  {func() Backend { return &jsonlBackend{} }, readJSONL, recoverLines},
+	"sqlite": {func() Backend { return &sqliteBackend{} }, readSQLite, recoverSQLite},
+	"binlog": {func() Backend { return &binlogBackend{} }, readBinlog, recoverBinlog},
+}
+
+// NewBackend creates a Backend by its name: csv, jsonl, sqlite or binlog.
+func NewBackend(name string) (Backend, error) {
+	format, found := formats[name]
+	if !found {
+		return nil, fmt.Errorf("unknown persistence backend '%s', available: %s", name, strings.Join(backendNames(), ", "))
+	}
+	return format.create(), nil
+}
+
+// ReadFile reads all records of a persistence file. The format is determined by the file extension. Compressed
+// files are decompressed into a temporary file first, encrypted files are decrypted while reading.
+func ReadFile(path string) ([]Record, error) {
+	name, remove, err := decompressFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if remove {
+		defer os.Remove(name)
+		path = name
+	}
+	ext := filepath.Ext(strings.TrimSuffix(path, encryptedExt))
+	for _, format := range formats {
+		if format.create().Extension() == ext {
+			return format.read(path)
+		}
+	}
+	return nil, fmt.Errorf("unknown persistence file format '%s'", ext)
+}
+
+// IsPersistenceFile reports if a file, compressed or not, has the extension of a persistence format.
+func IsPersistenceFile(path string) bool {
+	for _, e := range compressions {
+		path = strings.TrimSuffix(path, e)
+	}
+	ext := filepath.Ext(strings.TrimSuffix(path, encryptedExt))
+	for _, format := range formats {
+		if format.create().Extension() == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// backendNames returns the names of all backends.
+func backendNames() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,151 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// binlogMagic identifies binary persistence logs.
+const binlogMagic = "VSBLOG1\n"
+
+// binlogBackend writes records as binary length-prefixed log, which can be read back without any parsing of the
+// record data. Each record is stored as
+//
+//	uint32 length of the following fields (big endian)
+//	uint64 sequence number
+//	int64  unix time in nanoseconds
+//	int64  monotonic time since the broker start in nanoseconds
+//	source, command, topic, direction and hash, each prefixed with its uint16 length
+//	data
+type binlogBackend struct {
+	fileHandle fileWriter
+	writer     *bufio.Writer
+}
+
+func (b *binlogBackend) Extension() string {
+	return ".binlog"
+}
+
+func (b *binlogBackend) Open(name string) error {
+	f, err := createFile(name)
+	if err != nil {
+		return err
+	}
+	b.fileHandle = f
+	b.writer = bufio.NewWriter(f)
+	_, err = b.writer.WriteString(binlogMagic)
+	return err
+}
+
+func (b *binlogBackend) Write(rec Record) error {
+	body := encodeRecord(rec, rec.Source, rec.Command, rec.Topic, rec.Direction, rec.Hash)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)))
+	if _, err := b.writer.Write(length); err != nil {
+		return err
+	}
+	_, err := b.writer.Write(body)
+	return err
+}
+
+// encodeRecord encodes the sequence number, times, string fields and data of a record in the binary log format,
+// without length.
+func encodeRecord(rec Record, fields ...string) []byte {
+	body := make([]byte, 24, 24+len(rec.Data)+128)
+	binary.BigEndian.PutUint64(body[0:8], rec.Seq)
+	binary.BigEndian.PutUint64(body[8:16], uint64(rec.Time.UnixNano()))
+	binary.BigEndian.PutUint64(body[16:24], uint64(rec.Monotonic))
+	for _, field := range fields {
+		if len(field) > 0xffff {
+			field = field[:0xffff]
+		}
+		body = append(body, byte(len(field)>>8), byte(len(field)))
+		body = append(body, field...)
+	}
+	return append(body, rec.Data...)
+}
+
+func (b *binlogBackend) Flush() error {
+	if err := b.writer.Flush(); err != nil {
+		return err
+	}
+	return b.fileHandle.Flush()
+}
+
+func (b *binlogBackend) Sync() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.fileHandle.Sync()
+}
+
+func (b *binlogBackend) Close() error {
+	if err := b.Sync(); err != nil {
+		_ = b.fileHandle.Close()
+		return err
+	}
+	return b.fileHandle.Close()
+}
+
+// readBinlog reads all records of a binary persistence log.
+func readBinlog(path string) ([]Record, error) {
+	f, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	magic := make([]byte, len(binlogMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil || string(magic) != binlogMagic {
+		return nil, fmt.Errorf("'%s' is no binary persistence log", path)
+	}
+	var records []Record
+	length := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(reader, length); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(length))
+		if _, err = io.ReadFull(reader, body); err != nil {
+			return records, err
+		}
+		rec, err := decodeBinlogRecord(body)
+		if err != nil {
+			return records, fmt.Errorf("record %d: %v", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// decodeBinlogRecord decodes the fields of a record following its length.
+func decodeBinlogRecord(body []byte) (Record, error) {
+	rec := Record{}
+	err := decodeFields(body, &rec, &rec.Source, &rec.Command, &rec.Topic, &rec.Direction, &rec.Hash)
+	return rec, err
+}
+
+// decodeFields decodes the sequence number, times, string fields and data of a record.
+func decodeFields(body []byte, rec *Record, fields ...*string) error {
+	if len(body) < 24 {
+		return fmt.Errorf("record too short")
+	}
+	rec.Seq = binary.BigEndian.Uint64(body[0:8])
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(body[8:16])))
+	rec.Monotonic = time.Duration(binary.BigEndian.Uint64(body[16:24]))
+	body = body[24:]
+	for _, field := range fields {
+		if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+			return fmt.Errorf("record too short")
+		}
+		n := 2 + int(binary.BigEndian.Uint16(body))
+		*field = string(body[2:n])
+		body = body[n:]
+	}
+	rec.Data = body
+	return nil
+}
@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvBackend writes records as rows of a semicolon separated CSV file with a header row.
+type csvBackend struct {
+	fileHandle fileWriter
+	writer     *csv.Writer
+}
+
+func (b *csvBackend) Extension() string {
+	return ".csv"
+}
+
+func (b *csvBackend) Open(name string) error {
+	f, err := createFile(name)
+	if err != nil {
+		return err
+	}
+	b.fileHandle = f
+	b.writer = csv.NewWriter(b.fileHandle)
+	b.writer.Comma = ';'
+	return b.writer.Write(columns)
+}
+
+func (b *csvBackend) Write(rec Record) error {
+	return b.writer.Write(formatRow(rec))
+}
+
+func (b *csvBackend) Flush() error {
+	b.writer.Flush()
+	if err := b.writer.Error(); err != nil {
+		return err
+	}
+	return b.fileHandle.Flush()
+}
+
+func (b *csvBackend) Sync() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.fileHandle.Sync()
+}
+
+func (b *csvBackend) Close() error {
+	if err := b.Sync(); err != nil {
+		_ = b.fileHandle.Close()
+		return err
+	}
+	return b.fileHandle.Close()
+}
+
+// WriteCSV writes records in the CSV persistence file format, including the header row.
+func WriteCSV(w io.Writer, records []Record) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := writer.Write(formatRow(rec)); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatRow converts a Record to the columns of a tabular row.
+func formatRow(rec Record) []string {
+	return []string{
+		strconv.FormatUint(rec.Seq, 10),
+		rec.Time.Format(time.RFC3339Nano),
+		strconv.FormatInt(int64(rec.Monotonic), 10),
+		rec.Source,
+		rec.Command,
+		rec.Topic,
+		rec.Direction,
+		string(rec.Data),
+		rec.Hash,
+	}
+}
+
+// readCSV reads all records of a CSV persistence file. Files without header row are read in the former format with
+// the two columns source and data.
+func readCSV(path string) ([]Record, error) {
+	f, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.Comma = ';'
+	reader.FieldsPerRecord = -1
+	var records []Record
+	legacy := true
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		line, _ := reader.FieldPos(0)
+		if line == 1 && len(row) == len(columns) && row[0] == columns[0] {
+			legacy = false
+			continue
+		}
+		if legacy {
+			if len(row) < 2 {
+				return records, fmt.Errorf("line %d: expected 2 fields, got %d", line, len(row))
+			}
+			records = append(records, Record{
+				Source: row[0],
+				Data:   []byte(row[1]),
+			})
+			continue
+		}
+		rec, err := parseRow(row)
+		if err != nil {
+			return records, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// parseRow converts the columns of a tabular row to a Record.
+func parseRow(row []string) (Record, error) {
+	if len(row) != len(columns) {
+		return Record{}, fmt.Errorf("expected %d fields, got %d", len(columns), len(row))
+	}
+	seq, err := strconv.ParseUint(row[0], 10, 64)
+	if err != nil {
+		return Record{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, row[1])
+	if err != nil {
+		return Record{}, err
+	}
+	monotonic, err := strconv.ParseInt(row[2], 10, 64)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{
+		Seq:       seq,
+		Time:      t,
+		Monotonic: time.Duration(monotonic),
+		Source:    row[3],
+		Command:   row[4],
+		Topic:     row[5],
+		Direction: row[6],
+		Data:      []byte(row[7]),
+		Hash:      row[8],
+	}, nil
+}
@@ -0,0 +1,127 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// jsonlRecord is the representation of a Record in a JSON Lines file. Valid compact json data is embedded as is,
+// everything else as string, so the data is read back byte for byte.
+type jsonlRecord struct {
+	Seq       uint64          `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Monotonic int64           `json:"monotonic_ns"`
+	Source    string          `json:"source"`
+	Command   string          `json:"command"`
+	Topic     string          `json:"topic"`
+	Direction string          `json:"direction"`
+	Data      json.RawMessage `json:"data"`
+	Hash      string          `json:"hash,omitempty"`
+}
+
+// jsonlBackend writes records as JSON Lines.
+type jsonlBackend struct {
+	fileHandle fileWriter
+	writer     *bufio.Writer
+}
+
+func (b *jsonlBackend) Extension() string {
+	return ".jsonl"
+}
+
+func (b *jsonlBackend) Open(name string) error {
+	f, err := createFile(name)
+	if err != nil {
+		return err
+	}
+	b.fileHandle = f
+	b.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (b *jsonlBackend) Write(rec Record) error {
+	data := json.RawMessage(rec.Data)
+	compact := &bytes.Buffer{}
+	if json.Compact(compact, rec.Data) != nil || !bytes.Equal(compact.Bytes(), rec.Data) {
+		data, _ = json.Marshal(string(rec.Data))
+	}
+	line := &bytes.Buffer{}
+	encoder := json.NewEncoder(line)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(jsonlRecord{
+		Seq:       rec.Seq,
+		Time:      rec.Time,
+		Monotonic: int64(rec.Monotonic),
+		Source:    rec.Source,
+		Command:   rec.Command,
+		Topic:     rec.Topic,
+		Direction: rec.Direction,
+		Data:      data,
+		Hash:      rec.Hash,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.writer.Write(line.Bytes())
+	return err
+}
+
+func (b *jsonlBackend) Flush() error {
+	if err := b.writer.Flush(); err != nil {
+		return err
+	}
+	return b.fileHandle.Flush()
+}
+
+func (b *jsonlBackend) Sync() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.fileHandle.Sync()
+}
+
+func (b *jsonlBackend) Close() error {
+	if err := b.Sync(); err != nil {
+		_ = b.fileHandle.Close()
+		return err
+	}
+	return b.fileHandle.Close()
+}
+
+// readJSONL reads all records of a JSON Lines persistence file.
+func readJSONL(path string) ([]Record, error) {
+	f, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var records []Record
+	for line := 1; scanner.Scan(); line++ {
+		rec := jsonlRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return records, fmt.Errorf("line %d: %v", line, err)
+		}
+		data := []byte(rec.Data)
+		var s string
+		if json.Unmarshal(rec.Data, &s) == nil {
+			data = []byte(s)
+		}
+		records = append(records, Record{
+			Seq:       rec.Seq,
+			Time:      rec.Time,
+			Monotonic: time.Duration(rec.Monotonic),
+			Source:    rec.Source,
+			Command:   rec.Command,
+			Topic:     rec.Topic,
+			Direction: rec.Direction,
+			Data:      data,
+			Hash:      rec.Hash,
+		})
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the records table with indexes for time, source and command.
+const sqliteSchema = `
+PRAGMA journal_mode = WAL;
+PRAGMA synchronous = NORMAL;
+CREATE TABLE IF NOT EXISTS records (
+	seq          INTEGER PRIMARY KEY,
+	time         INTEGER NOT NULL,
+	monotonic_ns INTEGER NOT NULL,
+	source       TEXT NOT NULL,
+	command      TEXT NOT NULL,
+	topic        TEXT NOT NULL,
+	direction    TEXT NOT NULL,
+	data         BLOB NOT NULL,
+	hash         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_time ON records (time);
+CREATE INDEX IF NOT EXISTS records_source ON records (source);
+CREATE INDEX IF NOT EXISTS records_command ON records (command);
+`
+
+// sqliteBackend writes records into an embedded SQLite database. Writes are collected in a transaction, which is
+// committed on Flush.
+type sqliteBackend struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+func (b *sqliteBackend) Extension() string {
+	return ".db"
+}
+
+func (b *sqliteBackend) Open(name string) error {
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		return err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return err
+	}
+	b.db = db
+	return nil
+}
+
+func (b *sqliteBackend) Write(rec Record) error {
+	if b.tx == nil {
+		tx, err := b.db.Begin()
+		if err != nil {
+			return err
+		}
+		b.tx = tx
+	}
+	_, err := b.tx.Exec(
+		"INSERT INTO records (seq, time, monotonic_ns, source, command, topic, direction, data, hash) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		rec.Seq, rec.Time.UnixNano(), int64(rec.Monotonic), rec.Source, rec.Command, rec.Topic, rec.Direction, rec.Data,
+		rec.Hash,
+	)
+	return err
+}
+
+func (b *sqliteBackend) Flush() error {
+	if b.tx == nil {
+		return nil
+	}
+	err := b.tx.Commit()
+	b.tx = nil
+	return err
+}
+
+// Sync commits pending writes and checkpoints the write-ahead log, which syncs it to stable storage.
+func (b *sqliteBackend) Sync() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	_, err := b.db.Exec("PRAGMA wal_checkpoint(PASSIVE)")
+	return err
+}
+
+func (b *sqliteBackend) Close() error {
+	if err := b.Sync(); err != nil {
+		_ = b.db.Close()
+		return err
+	}
+	return b.db.Close()
+}
+
+// recoverSQLite leaves the recovery to SQLite, which rolls back incomplete transactions on its own.
+func recoverSQLite(path string) (int64, error) {
+	return 0, nil
+}
+
+// readSQLite reads all records of a SQLite persistence database.
+func readSQLite(path string) ([]Record, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(
+		"SELECT seq, time, monotonic_ns, source, command, topic, direction, data, hash FROM records ORDER BY seq",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		rec := Record{}
+		var t, monotonic int64
+		err = rows.Scan(
+			&rec.Seq, &t, &monotonic, &rec.Source, &rec.Command, &rec.Topic, &rec.Direction, &rec.Data, &rec.Hash,
+		)
+		if err != nil {
+			return records, err
+		}
+		rec.Time = time.Unix(0, t)
+		rec.Monotonic = time.Duration(monotonic)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
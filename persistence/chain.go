@@ -0,0 +1,234 @@
+package persistence
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ChainSegment summarizes the hash chain of a segment, i.e. the records written to one set of backend files.
+type ChainSegment struct {
+	File      string `json:"file"`
+	FirstSeq  uint64 `json:"first_seq"`
+	LastSeq   uint64 `json:"last_seq"`
+	Records   int    `json:"records"`
+	FinalHash string `json:"final_hash"`
+}
+
+// Verification is the result of verifying the hash chain of a persistence file.
+type Verification struct {
+	File      string
+	Records   int
+	FirstSeq  uint64
+	LastSeq   uint64
+	FinalHash string
+	Problems  []string
+}
+
+// chainHash returns the hex encoded SHA-256 hash of the previous record's hash followed by the binary encoding of a
+// record without its hash. The first record of a file has no previous hash.
+func chainHash(prev string, rec Record) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(encodeRecord(rec, rec.Source, rec.Command, rec.Topic, rec.Direction))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadSigningKey reads a base64 encoded Ed25519 private key. If the file does not exist, a new key is generated and
+// stored along with its public key in a ".pub" file.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644)
+		fmt.Printf("Generated signing key '%s'\n", path)
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("'%s' is no Ed25519 private key", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// LoadPublicKey reads a base64 encoded Ed25519 public key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(strings.TrimSpace(string(data)))
+}
+
+// parsePublicKey decodes a base64 encoded Ed25519 public key.
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("no Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// digest returns the message signed for a session: the hash of its compact JSON encoding without signature and
+// public key. The encoding is canonical, as fields keep their order and map keys are sorted.
+func (s *Session) digest() ([]byte, error) {
+	unsigned := *s
+	unsigned.Signature, unsigned.PublicKey = "", ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// sign signs the session's digest and adds the signature and the public key to the session.
+func (s *Session) sign(key ed25519.PrivateKey) error {
+	digest, err := s.digest()
+	if err != nil {
+		return err
+	}
+	s.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	s.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+	return nil
+}
+
+// VerifySignature checks the session's signature. Without a key, the public key stored in the manifest is used,
+// which only proves the manifest is consistent, not who signed it.
+func (s *Session) VerifySignature(key ed25519.PublicKey) error {
+	if s.Signature == "" {
+		return fmt.Errorf("manifest is not signed")
+	}
+	if key == nil {
+		var err error
+		if key, err = parsePublicKey(s.PublicKey); err != nil {
+			return fmt.Errorf("manifest: %v", err)
+		}
+	}
+	digest, err := s.digest()
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil || !ed25519.Verify(key, digest, signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// Segment returns the chain segment of a persistence file of the session.
+func (s *Session) Segment(file string) (ChainSegment, bool) {
+	name := SegmentName(file)
+	for _, seg := range s.Segments {
+		if seg.File == name {
+			return seg, true
+		}
+	}
+	return ChainSegment{}, false
+}
+
+// ReadManifest reads a session manifest. Encrypted manifests are decrypted with the configured key or passphrase.
+func ReadManifest(path string) (*Session, error) {
+	f, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// VerifyFile checks the hash chain of a persistence file for gaps in the sequence numbers and for modified records.
+func VerifyFile(path string) (Verification, error) {
+	v := Verification{File: path}
+	records, err := ReadFile(path)
+	if err != nil {
+		return v, err
+	}
+	v.Records = len(records)
+	prev := ""
+	for i, rec := range records {
+		if rec.Hash == "" {
+			v.Problems = append(v.Problems, fmt.Sprintf("record %d has no hash", rec.Seq))
+			return v, nil
+		}
+		if i == 0 {
+			v.FirstSeq = rec.Seq
+		} else if rec.Seq != v.LastSeq+1 {
+			v.Problems = append(v.Problems, fmt.Sprintf("gap: record %d follows record %d", rec.Seq, v.LastSeq))
+		}
+		if chainHash(prev, rec) != rec.Hash {
+			v.Problems = append(v.Problems, fmt.Sprintf("record %d does not match its hash", rec.Seq))
+		}
+		prev = rec.Hash
+		v.LastSeq = rec.Seq
+	}
+	v.FinalHash = prev
+	if strings.HasSuffix(path, encryptedExt) {
+		f, err := OpenFile(path)
+		if err != nil {
+			return v, err
+		}
+		_, err = io.Copy(ioutil.Discard, f)
+		_ = f.Close()
+		if err != nil {
+			return v, err
+		}
+		if Recovered(f) {
+			v.Problems = append(v.Problems, "truncated by a crash and sealed on recovery, the last records may be missing")
+		}
+	}
+	return v, nil
+}
+
+// closeChain adds the hash chain of the current segment to the chains of its folder, if it belongs to a session.
+func (ph *PersistenceHandler) closeChain() {
+	if !ph.chained || len(ph.files) == 0 {
+		return
+	}
+	seg := ChainSegment{
+		File:      SegmentName(ph.files[0]),
+		FirstSeq:  ph.chainFirst,
+		Records:   ph.chainCount,
+		FinalHash: ph.chain,
+	}
+	if ph.chainCount > 0 {
+		seg.LastSeq = ph.seq
+	}
+	ph.chainMu.Lock()
+	ph.chains[ph.folder] = append(ph.chains[ph.folder], seg)
+	ph.chainMu.Unlock()
+}
+
+// takeChains returns and forgets the hash chains of the segments within a folder.
+func (ph *PersistenceHandler) takeChains(folder string) []ChainSegment {
+	ph.chainMu.Lock()
+	defer ph.chainMu.Unlock()
+	chains := ph.chains[folder]
+	delete(ph.chains, folder)
+	return chains
+}
@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVerifyFile(t *testing.T) {
+	tampered := testRecords(3)
+	tampered[1].Data = []byte(`[["msg",{"text":"changed"}]]`)
+	complete := testRecords(3)
+	for _, test := range []struct {
+		name     string
+		records  []Record
+		problems []string
+	}{
+		{"intact", testRecords(3), nil},
+		{"modified", tampered, []string{"record 2 does not match its hash"}},
+		{"removed", []Record{complete[0], complete[2]}, []string{
+			"gap: record 3 follows record 1",
+			"record 3 does not match its hash",
+		}},
+		{"unchained", []Record{{Seq: 1, Source: "client", Data: []byte("1")}}, []string{"record 1 has no hash"}},
+	} {
+		for _, backend := range []string{"csv", "jsonl", "binlog", "sqlite"} {
+			t.Run(test.name+"/"+backend, func(t *testing.T) {
+				b, _ := NewBackend(backend)
+				path := filepath.Join(t.TempDir(), "events"+b.Extension())
+				writeRecords(t, backend, path, test.records)
+				v, err := VerifyFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(v.Problems, test.problems) {
+					t.Errorf("got problems %q, want %q", v.Problems, test.problems)
+				}
+				if v.Records != len(test.records) {
+					t.Errorf("got %d records, want %d", v.Records, len(test.records))
+				}
+			})
+		}
+	}
+}
+
+func TestSessionSignature(t *testing.T) {
+	key, err := loadSigningKey(filepath.Join(t.TempDir(), "signing.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Session{
+		ID:          "20240301-100000_P01",
+		Participant: "P01",
+		Metadata:    map[string]interface{}{"group": "a", "age": 31.0},
+		Start:       time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		Config:      map[string]string{"PERSIST_BACKENDS": "csv"},
+		Directory:   t.TempDir(),
+		Segments:    []ChainSegment{{File: "events.csv", FirstSeq: 1, LastSeq: 3, Records: 3, FinalHash: "abc"}},
+		FinalHash:   "abc",
+	}
+	if err = s.VerifySignature(nil); err == nil || err.Error() != "manifest is not signed" {
+		t.Errorf("unsigned manifest: got %v", err)
+	}
+	if err = s.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeManifest(s); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(ManifestPath(s.Directory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pub := range []ed25519.PublicKey{nil, key.Public().(ed25519.PublicKey)} {
+		if err = read.VerifySignature(pub); err != nil {
+			t.Errorf("key %v: %v", pub, err)
+		}
+	}
+	if err = read.VerifySignature(other); err == nil {
+		t.Error("signature verified with another key")
+	}
+	read.Segments[0].Records = 2
+	if err = read.VerifySignature(nil); err == nil {
+		t.Error("signature verified after modifying the segments")
+	}
+}
+
+func TestSessionChain(t *testing.T) {
+	ph := testHandler(t, PolicyBlock, 16)
+	key, err := loadSigningKey(filepath.Join(t.TempDir(), "signing.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ph.signingKey = key
+	go ph.persistRoutine()
+	defer ph.Close()
+	if err = ph.StartSession(&Session{Participant: "P01"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ph.AddRecord(Record{Source: "client", Data: []byte(`[["msg",{}]]`)})
+	}
+	s, err := ph.EndSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(ManifestPath(s.Directory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = read.VerifySignature(key.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Segments) != 1 {
+		t.Fatalf("got %d segments", len(read.Segments))
+	}
+	v, err := VerifyFile(filepath.Join(s.Directory, read.Segments[0].File+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Problems) > 0 || v.Records != 3 || v.FinalHash != read.FinalHash {
+		t.Errorf("got verification %+v for manifest with final hash %s", v, read.FinalHash)
+	}
+}
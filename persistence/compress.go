@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressions maps the compression methods to the extension of compressed files.
+var compressions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// compressFile compresses a file with a method and removes the original file.
+func compressFile(path string, method string) error {
+	ext, found := compressions[method]
+	if !found {
+		return fmt.Errorf("unknown compression '%s'", method)
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+ext, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser
+	if method == "gzip" {
+		w = gzip.NewWriter(dst)
+	} else if w, err = zstd.NewWriter(dst); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if _, err = io.Copy(w, src); err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + ext)
+		return err
+	}
+	_ = src.Close()
+	return os.Remove(path)
+}
+
+// decompressFile writes the decompressed content of a compressed file to a temporary file, keeping the inner
+// extension. The caller has to remove the returned file. Uncompressed files are returned as is, with remove set to
+// false.
+func decompressFile(path string) (name string, remove bool, err error) {
+	ext := filepath.Ext(path)
+	var method string
+	for m, e := range compressions {
+		if e == ext {
+			method = m
+		}
+	}
+	if method == "" {
+		return path, false, nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer src.Close()
+	var r io.Reader
+	if method == "gzip" {
+		gr, err := gzip.NewReader(src)
+		if err != nil {
+			return "", false, err
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return "", false, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	inner := filepath.Ext(strings.TrimSuffix(path, ext))
+	dst, err := ioutil.TempFile("", "persistence-*"+inner)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err = io.Copy(dst, r); err == nil {
+		err = dst.Close()
+	} else {
+		_ = dst.Close()
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return "", false, err
+	}
+	return dst.Name(), true, nil
+}
@@ -0,0 +1,448 @@
+package persistence
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// encryptedExt is appended to the names of encrypted persistence files.
+	encryptedExt = ".enc"
+	// encryptedMagic identifies encrypted persistence files. It is followed by the key mode and the salt.
+	encryptedMagic = "VSENC1\n"
+	saltSize       = 16
+	// modePassphrase derives the file key from a passphrase with scrypt.
+	modePassphrase = 'p'
+	// modeKey derives the file key from a key file with HMAC-SHA256.
+	modeKey = 'k'
+	// recoveredMarker is the content of the final chunk the crash recovery appends, which marks the file as truncated.
+	recoveredMarker = "recovered"
+)
+
+// ErrTruncated reports an encrypted file that ends without its final chunk, e.g. after a crash.
+var ErrTruncated = errors.New("encrypted file is truncated")
+
+// keySource holds the key or passphrase files are encrypted with.
+type keySource struct {
+	key        []byte
+	passphrase string
+}
+
+var (
+	encryptionMu     sync.Mutex
+	encryption       *keySource
+	encryptionLoaded bool
+)
+
+// fileWriter is the file a backend writes to, plain or encrypted.
+type fileWriter interface {
+	io.Writer
+	// Flush ends a batch of complete records. Encrypted files seal the batch into a chunk.
+	Flush() error
+	Sync() error
+	Close() error
+}
+
+// plainFile is an unencrypted fileWriter.
+type plainFile struct {
+	*os.File
+}
+
+func (p plainFile) Flush() error {
+	return nil
+}
+
+// encryptionFromEnv reads the encryption configuration. The key file takes precedence over the passphrase:
+//
+//	PERSIST_ENCRYPTION_KEY_FILE:        file holding a base64 encoded 32 byte key, generated if missing
+//	PERSIST_ENCRYPTION_PASSPHRASE_FILE: file holding a passphrase
+//	PERSIST_ENCRYPTION_PASSPHRASE:      passphrase
+func encryptionFromEnv() (*keySource, error) {
+	if path := os.Getenv("PERSIST_ENCRYPTION_KEY_FILE"); path != "" {
+		return loadEncryptionKey(path, true)
+	}
+	if path := os.Getenv("PERSIST_ENCRYPTION_PASSPHRASE_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return passphraseSource(strings.TrimRight(string(data), "\r\n"))
+	}
+	if passphrase := os.Getenv("PERSIST_ENCRYPTION_PASSPHRASE"); passphrase != "" {
+		return passphraseSource(passphrase)
+	}
+	return nil, nil
+}
+
+// passphraseSource creates a keySource for a non-empty passphrase.
+func passphraseSource(passphrase string) (*keySource, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return &keySource{passphrase: passphrase}, nil
+}
+
+// loadEncryptionKey reads a base64 encoded key. If the file does not exist and generate is set, a new random key is
+// generated.
+func loadEncryptionKey(path string, generate bool) (*keySource, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && generate {
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Generated encryption key '%s', keep a copy: without it, the recordings cannot be decrypted\n", path)
+		return &keySource{key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("'%s' is no encryption key", path)
+	}
+	return &keySource{key: key}, nil
+}
+
+// SetDecryption configures the key file or passphrase to read encrypted files with, replacing the configuration
+// from the environment.
+func SetDecryption(keyFile string, passphrase string) error {
+	var ks *keySource
+	var err error
+	if keyFile != "" {
+		ks, err = loadEncryptionKey(keyFile, false)
+	} else {
+		ks, err = passphraseSource(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	encryptionMu.Lock()
+	encryption, encryptionLoaded = ks, true
+	encryptionMu.Unlock()
+	return nil
+}
+
+// currentEncryption returns the configured key source, read from the environment on first use.
+func currentEncryption() (*keySource, error) {
+	encryptionMu.Lock()
+	defer encryptionMu.Unlock()
+	if !encryptionLoaded {
+		ks, err := encryptionFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		encryption, encryptionLoaded = ks, true
+	}
+	return encryption, nil
+}
+
+// mode returns the key mode stored in the file header.
+func (ks *keySource) mode() byte {
+	if ks.key != nil {
+		return modeKey
+	}
+	return modePassphrase
+}
+
+// aead derives the key of a file from its salt and creates its cipher.
+func (ks *keySource) aead(mode byte, salt []byte) (cipher.AEAD, error) {
+	var key []byte
+	switch {
+	case mode == modeKey && ks.key != nil:
+		mac := hmac.New(sha256.New, ks.key)
+		mac.Write(salt)
+		key = mac.Sum(nil)
+	case mode == modePassphrase && ks.passphrase != "":
+		var err error
+		if key, err = scrypt.Key([]byte(ks.passphrase), salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	case mode == modeKey:
+		return nil, fmt.Errorf("the file is encrypted with a key file, not a passphrase")
+	case mode == modePassphrase:
+		return nil, fmt.Errorf("the file is encrypted with a passphrase, not a key file")
+	default:
+		return nil, fmt.Errorf("unknown key mode")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk: a flag marking the final chunk followed by the chunk counter.
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	if final {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// encryptedFile encrypts everything written to a file with AES-256-GCM in chunks. The data written between two
+// flushes is sealed into one chunk, so chunks hold complete records and a torn chunk after a crash only loses whole
+// records. Each chunk is stored as its uint32 length followed by the ciphertext. Close appends an empty final chunk,
+// which lets readers detect truncated files. The crash recovery appends a final chunk with the recovered marker.
+type encryptedFile struct {
+	f       *os.File
+	aead    cipher.AEAD
+	counter uint64
+	pending []byte
+}
+
+// createFile creates a file for a backend. Files named with the encrypted extension are encrypted.
+func createFile(name string) (fileWriter, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, encryptedExt) {
+		return plainFile{f}, nil
+	}
+	ks, err := currentEncryption()
+	if err == nil && ks == nil {
+		err = fmt.Errorf("no encryption key configured")
+	}
+	var aead cipher.AEAD
+	salt := make([]byte, saltSize)
+	if err == nil {
+		_, err = rand.Read(salt)
+	}
+	if err == nil {
+		aead, err = ks.aead(ks.mode(), salt)
+	}
+	if err == nil {
+		_, err = f.Write(append(append([]byte(encryptedMagic), ks.mode()), salt...))
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &encryptedFile{f: f, aead: aead}, nil
+}
+
+func (e *encryptedFile) Write(p []byte) (int, error) {
+	e.pending = append(e.pending, p...)
+	return len(p), nil
+}
+
+// Flush seals the data written since the previous flush into a chunk.
+func (e *encryptedFile) Flush() error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	err := e.writeChunk(e.pending, false)
+	e.pending = e.pending[:0]
+	return err
+}
+
+// writeChunk seals and writes a chunk.
+func (e *encryptedFile) writeChunk(p []byte, final bool) error {
+	sealed := e.aead.Seal(make([]byte, 4, 4+len(p)+e.aead.Overhead()), chunkNonce(e.counter, final), p, nil)
+	binary.BigEndian.PutUint32(sealed[0:4], uint32(len(sealed)-4))
+	e.counter++
+	_, err := e.f.Write(sealed)
+	return err
+}
+
+func (e *encryptedFile) Sync() error {
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	return e.f.Sync()
+}
+
+func (e *encryptedFile) Close() error {
+	err := e.Flush()
+	if err == nil {
+		err = e.writeChunk(nil, true)
+	}
+	if err == nil {
+		err = e.f.Sync()
+	}
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// decryptReader reads the plaintext of an encrypted file.
+type decryptReader struct {
+	f         *os.File
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	counter   uint64
+	buf       []byte
+	final     bool
+	recovered bool
+}
+
+// OpenFile opens a persistence file for reading. Encrypted files are decrypted on the fly with the configured key
+// or passphrase.
+func OpenFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(path, encryptedExt) {
+		return f, err
+	}
+	d := &decryptReader{f: f, r: bufio.NewReader(f)}
+	header := make([]byte, len(encryptedMagic)+1+saltSize)
+	if _, err = io.ReadFull(d.r, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		_ = f.Close()
+		return nil, fmt.Errorf("'%s' is no encrypted persistence file", path)
+	}
+	ks, err := currentEncryption()
+	if err == nil && ks == nil {
+		err = fmt.Errorf("'%s' is encrypted, but no key or passphrase is configured", path)
+	}
+	if err == nil {
+		d.aead, err = ks.aead(header[len(encryptedMagic)], header[len(encryptedMagic)+1:])
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk.
+func (d *decryptReader) next() error {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, length); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	} else if err != nil {
+		return err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint32(length))
+	if _, err := io.ReadFull(d.r, sealed); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	} else if err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(nil, chunkNonce(d.counter, false), sealed, nil)
+	if err != nil {
+		if plain, err = d.aead.Open(nil, chunkNonce(d.counter, true), sealed, nil); err != nil {
+			return fmt.Errorf("chunk %d: wrong key or modified data", d.counter)
+		}
+		d.final = true
+		if _, err = d.r.Peek(1); err != io.EOF {
+			return fmt.Errorf("data after the final chunk")
+		}
+		if string(plain) == recoveredMarker {
+			d.recovered = true
+			plain = nil
+		}
+	}
+	d.counter++
+	d.buf = plain
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
+
+// Recovered reports if a file opened with OpenFile was sealed by the crash recovery, so its last records may be
+// missing. It is known once the file was read to the end.
+func Recovered(r io.Reader) bool {
+	d, ok := r.(*decryptReader)
+	return ok && d.recovered
+}
+
+// recoverEncrypted truncates an encrypted file after its last complete chunk. If the key is available, a final chunk
+// with the recovered marker is appended, so the file can be read without errors, but is still reported as truncated.
+func recoverEncrypted(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	header := make([]byte, len(encryptedMagic)+1+saltSize)
+	if _, err = f.ReadAt(header, 0); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return 0, nil
+	}
+	end, last := int64(len(header)), int64(-1)
+	var chunks uint64
+	length := make([]byte, 4)
+	for end < size {
+		if _, err = f.ReadAt(length, end); err != nil && err != io.EOF {
+			return 0, err
+		}
+		next := end + 4 + int64(binary.BigEndian.Uint32(length))
+		if err == io.EOF || next > size {
+			break
+		}
+		last, end = end, next
+		chunks++
+	}
+	if end < size {
+		if err = f.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	ks, err := currentEncryption()
+	if err != nil || ks == nil {
+		return size - end, err
+	}
+	aead, err := ks.aead(header[len(encryptedMagic)], header[len(encryptedMagic)+1:])
+	if err != nil {
+		return size - end, err
+	}
+	if last >= 0 {
+		sealed := make([]byte, end-last-4)
+		if _, err = f.ReadAt(sealed, last+4); err != nil {
+			return size - end, err
+		}
+		if _, err = aead.Open(nil, chunkNonce(chunks-1, true), sealed, nil); err == nil {
+			return size - end, nil
+		}
+	}
+	if _, err = f.Seek(end, io.SeekStart); err != nil {
+		return size - end, err
+	}
+	e := &encryptedFile{f: f, aead: aead, counter: chunks}
+	if err = e.writeChunk([]byte(recoveredMarker), true); err != nil {
+		return size - end, err
+	}
+	fmt.Printf("Recovered '%s': sealed the file and marked it as truncated\n", path)
+	return size - end, f.Sync()
+}
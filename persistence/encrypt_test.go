@@ -0,0 +1,154 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setEncryption configures a key source for the duration of a test.
+func setEncryption(t *testing.T, ks *keySource) {
+	encryptionMu.Lock()
+	encryption, encryptionLoaded = ks, true
+	encryptionMu.Unlock()
+	t.Cleanup(func() {
+		encryptionMu.Lock()
+		encryption, encryptionLoaded = nil, false
+		encryptionMu.Unlock()
+	})
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "encryption.key")
+	key, err := loadEncryptionKey(keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ks := range []*keySource{key, {passphrase: "correct horse battery staple"}} {
+		for _, backend := range []string{"csv", "jsonl", "binlog"} {
+			t.Run(string(ks.mode())+"/"+backend, func(t *testing.T) {
+				setEncryption(t, ks)
+				b, _ := NewBackend(backend)
+				path := filepath.Join(t.TempDir(), "events"+b.Extension()+encryptedExt)
+				records := testRecords(3)
+				writeRecords(t, backend, path, records)
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(data, []byte(encryptedMagic)) || bytes.Contains(data, records[0].Data) {
+					t.Error("file is not encrypted")
+				}
+				got, err := ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkRecords(t, got, records)
+				setEncryption(t, &keySource{passphrase: "wrong"})
+				if _, err = ReadFile(path); err == nil {
+					t.Error("decrypted with the wrong passphrase")
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	setEncryption(t, &keySource{passphrase: "secret"})
+	for _, test := range []struct {
+		name    string
+		cut     int64
+		records int
+	}{
+		// The empty final chunk consists of its length and the GCM tag
+		{"final chunk missing", 4 + 16, 3},
+		{"torn chunk", 4 + 16 + 5, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "events.jsonl"+encryptedExt)
+			records := testRecords(3)
+			b := &jsonlBackend{}
+			if err := b.Open(path); err != nil {
+				t.Fatal(err)
+			}
+			// One chunk per record
+			for _, rec := range records {
+				if err := b.Write(rec); err != nil {
+					t.Fatal(err)
+				}
+				if err := b.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.Truncate(path, info.Size()-test.cut); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadFile(path)
+			if !errors.Is(err, ErrTruncated) {
+				t.Errorf("got error %v, want %v", err, ErrTruncated)
+			}
+			checkRecords(t, got, records[:test.records])
+
+			recoverFolder(dir)
+			got, err = ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRecords(t, got, records[:test.records])
+			v, err := VerifyFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v.Problems) != 1 || !strings.HasPrefix(v.Problems[0], "truncated") {
+				t.Errorf("got problems %q", v.Problems)
+			}
+			f, err := OpenFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err = ioutil.ReadAll(f); err != nil {
+				t.Fatal(err)
+			}
+			if !Recovered(f) {
+				t.Error("recovered file is not marked")
+			}
+		})
+	}
+}
+
+func TestEncryptedManifest(t *testing.T) {
+	setEncryption(t, &keySource{passphrase: "secret"})
+	s := &Session{ID: "20240301-100000_P01", Participant: "P01", Directory: t.TempDir()}
+	if err := writeManifest(s); err != nil {
+		t.Fatal(err)
+	}
+	path := ManifestPath(s.Directory)
+	if path != filepath.Join(s.Directory, ManifestName+encryptedExt) {
+		t.Fatalf("got manifest '%s'", path)
+	}
+	read, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, s) {
+		t.Errorf("got %+v, want %+v", read, s)
+	}
+	setEncryption(t, nil)
+	if _, err = ReadManifest(path); err == nil {
+		t.Error("read encrypted manifest without key")
+	}
+}
@@ -1,90 +1,404 @@
 package persistence
 
 import (
-	"encoding/csv"
+	"crypto/ed25519"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// PersistenceHandler represents a handler to persist Command to a CSV file.
+// Persister accepts records to persist.
+type Persister interface {
+	AddRecord(rec Record)
+}
+
+// PersistenceHandler represents a handler to persist Command to one or more backends, configured through
+// PERSIST_BACKENDS. The files of all backends are written by a single routine, fed by a buffered queue, and rotated
+// into new segments by size, interval or session.
 type PersistenceHandler struct {
-	active     bool
-	fileHandle *os.File
-	writer     *csv.Writer
-	writeChan  chan []string
+	counters    queueCounters
+	active      bool
+	mu          sync.Mutex
+	backends    []Backend
+	writeChan   chan queueItem
+	archiveChan chan archiveJob
+	rotation    rotation
+	session     *Session
+	started     time.Time
+	seq         uint64
+	folder      string
+	naming      *Session
+	segment     int
+	opened      time.Time
+	files       []string
+	syncEvery   time.Duration
+	dirty       bool
+	synced      time.Time
+	done        chan struct{}
+	archived    chan struct{}
+	policy      string
+	spill       spillFile
+	batch       []time.Time
+	chain       string
+	chainFirst  uint64
+	chainCount  int
+	chained     bool
+	chainMu     sync.Mutex
+	chains      map[string][]ChainSegment
+	signingKey  ed25519.PrivateKey
+	redaction   redaction
+	encrypted   bool
+}
+
+// queueItem is either a record to write, a request to rotate the files into a folder, named after a session, or a
+// request to close the files. Rotations and closing pass the same channel as records to keep their order.
+type queueItem struct {
+	record  Record
+	rotate  *string
+	session *Session
+	close   bool
+	done    chan struct{}
+	queued  time.Time
 }
 
 // NewPersistenceHandler creates a new PersistenceHandler and creates persistence files
 func NewPersistenceHandler() *PersistenceHandler {
-	ph := &PersistenceHandler{}
+	ph := &PersistenceHandler{
+		started: time.Now(),
+		done:    make(chan struct{}),
+		chains:  make(map[string][]ChainSegment),
+	}
 	enabled, err := strconv.ParseBool(os.Getenv("PERSIST_EVENTS"))
 	if err != nil {
 		enabled = false // fallback to false
 	}
 	ph.active = enabled
 	if ph.active {
-		ph.openFile()
-		ph.writeChan = make(chan []string)
+		names := os.Getenv("PERSIST_BACKENDS")
+		if names == "" {
+			names = "csv"
+		}
+		ks, err := currentEncryption()
+		if err != nil {
+			fmt.Println(err)
+		}
+		ph.encrypted = ks != nil
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if ph.encrypted && name == "sqlite" {
+				fmt.Println("The sqlite backend does not support encryption and is disabled")
+				continue
+			}
+			b, err := NewBackend(name)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			ph.backends = append(ph.backends, b)
+		}
+		ph.syncEvery = time.Second
+		if v := os.Getenv("PERSIST_FSYNC_INTERVAL"); v != "" {
+			if ph.syncEvery, err = time.ParseDuration(v); err != nil {
+				fmt.Println(err)
+				ph.syncEvery = time.Second
+			}
+		}
+		if v := os.Getenv("PERSIST_SIGNING_KEY"); v != "" {
+			if ph.signingKey, err = loadSigningKey(v); err != nil {
+				fmt.Println(err)
+			}
+		}
+		ph.redaction = redactionFromEnv()
+		ph.rotation = rotationFromEnv()
+		if ph.encrypted && ph.rotation.compress != "" {
+			fmt.Println("Encrypted files are not compressed")
+			ph.rotation.compress = ""
+		}
+		if ph.rotation.archives() {
+			ph.archiveChan = make(chan archiveJob, 16)
+			ph.archived = make(chan struct{})
+			go ph.archiveRoutine()
+		}
+		recoverFolder(baseFolder())
+		ph.openFiles(baseFolder())
+		size, policy := queueFromEnv()
+		ph.policy = policy
+		ph.writeChan = make(chan queueItem, size)
 		go ph.persistRoutine()
 	}
 	return ph
 }
 
-// createFilename assembles a filename for the logs.
-func (ph *PersistenceHandler) createFilename() string {
-	date := time.Now().Format("20060102-150405")
+// baseFolder returns the configured persistence folder.
+func baseFolder() string {
+	return os.Getenv("PERSIST_FOLDER")
+}
+
+// filePattern returns the configured file name pattern without extension.
+func filePattern() string {
 	pattern := os.Getenv("PERSIST_PATTERN")
 	if pattern == "" {
 		pattern = "events_{date}.csv"
 	}
+	return strings.TrimSuffix(pattern, filepath.Ext(pattern))
+}
+
+// createFilename assembles a filename for the logs within a folder. The extension is left to the backends.
+// Supported placeholders are {date}, {session}, {participant} and {seq}, the segment number within the folder. If
+// the resulting files already exist, a suffix is added.
+func (ph *PersistenceHandler) createFilename(folder string) string {
+	pattern := filePattern()
 	placeholders := make(map[string]string)
-	placeholders[`{date}`] = date
+	placeholders[`{date}`] = time.Now().Format("20060102-150405")
+	placeholders[`{seq}`] = fmt.Sprintf("%03d", ph.segment)
+	placeholders[`{session}`] = ""
+	placeholders[`{participant}`] = ""
+	if s := ph.naming; s != nil {
+		placeholders[`{session}`] = s.ID
+		placeholders[`{participant}`] = s.Participant
+	}
 	for name, subst := range placeholders {
-		pattern = strings.Replace(pattern, name, subst, 1)
+		pattern = strings.Replace(pattern, name, subst, -1)
 	}
-	folder := os.Getenv("PERSIST_FOLDER")
-	if folder != "" {
-		folder += string(os.PathSeparator)
+	name := filepath.Join(folder, pattern)
+	for i := 2; ph.exists(name); i++ {
+		name = filepath.Join(folder, fmt.Sprintf("%s_%d", pattern, i))
 	}
-	return folder + pattern
+	return name
 }
 
-// openFile creates a new file and provides a new csv.Writer to it.
-func (ph *PersistenceHandler) openFile() {
-	f, err := os.OpenFile(ph.createFilename(), os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		fmt.Println(err)
+// exists reports if any backend file, compressed or not, exists for a file name without extension.
+func (ph *PersistenceHandler) exists(name string) bool {
+	for _, b := range ph.backends {
+		candidates := []string{name + b.Extension(), name + b.Extension() + encryptedExt}
+		for _, ext := range compressions {
+			candidates = append(candidates, name+b.Extension()+ext)
+		}
+		for _, candidate := range candidates {
+			if _, err := os.Stat(candidate); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openFiles opens a new segment within a folder with a file for every backend.
+func (ph *PersistenceHandler) openFiles(folder string) {
+	if folder != ph.folder {
+		ph.segment = 0
+	}
+	ph.folder = folder
+	ph.segment++
+	ph.opened = time.Now()
+	ph.synced = ph.opened
+	ph.dirty = false
+	ph.chain = ""
+	ph.chainCount = 0
+	ph.chained = ph.naming != nil
+	name := ph.createFilename(folder)
+	ph.files = nil
+	for _, b := range ph.backends {
+		file := name + b.Extension()
+		if ph.encrypted {
+			file += encryptedExt
+		}
+		if err := b.Open(file); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		ph.files = append(ph.files, file)
+	}
+}
+
+// closeFiles flushes and closes the files of all backends.
+func (ph *PersistenceHandler) closeFiles() {
+	for _, b := range ph.backends {
+		if err := b.Close(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// nextSegment closes the current segment, opens a new one within a folder and hands the closed segment over for
+// archiving.
+func (ph *PersistenceHandler) nextSegment(folder string) {
+	job := archiveJob{
+		files:  ph.files,
+		folder: ph.folder,
+	}
+	ph.closeChain()
+	ph.closeFiles()
+	ph.openFiles(folder)
+	if ph.archiveChan != nil {
+		if len(ph.files) > 0 && ph.folder == job.folder {
+			job.current = segmentStem(ph.files[0])
+		}
+		ph.archiveChan <- job
 	}
-	ph.fileHandle = f
-	ph.writer = csv.NewWriter(ph.fileHandle)
-	ph.writer.Comma = ';'
 }
 
-// closeFile closes the writers to the persistence file.
-func (ph *PersistenceHandler) closeFile() {
-	close(ph.writeChan)
-	if err := ph.fileHandle.Close(); err != nil {
-		fmt.Println(err)
+// rotate closes the current files and continues writing to new files within a folder, named after a session. It
+// returns after all previously added entries have been written to the old files.
+func (ph *PersistenceHandler) rotate(folder string, session *Session) {
+	done := make(chan struct{})
+	select {
+	case ph.writeChan <- queueItem{rotate: &folder, session: session, done: done}:
+		<-done
+	case <-ph.done:
 	}
 }
 
-// persistRoutine reads from the persistence channel and writes to the file
+// persistRoutine reads from the persistence channel and writes to the backends. Records waiting in the channel are
+// written as one batch, which is flushed once and synced to stable storage at most every PERSIST_FSYNC_INTERVAL
+// (default 1s, 0 syncs every batch). Spilled records are written after each batch and on every tick, before segments
+// exceeding the configured size or age are rotated.
 func (ph *PersistenceHandler) persistRoutine() {
+	tick := time.Second
+	if ph.syncEvery > 0 && ph.syncEvery < tick {
+		tick = ph.syncEvery
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
 	for {
-		buf := <-ph.writeChan
-		if err := ph.writer.Write(buf); err != nil {
+		select {
+		case item := <-ph.writeChan:
+			if !ph.handle(item) {
+				return
+			}
+			// Group commit: write everything that is waiting before flushing
+			for batched := true; batched; {
+				select {
+				case item = <-ph.writeChan:
+					if !ph.handle(item) {
+						return
+					}
+				default:
+					batched = false
+				}
+			}
+		case <-ticker.C:
+		}
+		// Spilled records are written on the ticker as well, the queue may stay empty after spilling
+		ph.unspill()
+		if len(ph.batch) > 0 {
+			ph.flush()
+		}
+		if ph.dirty && time.Since(ph.synced) >= ph.syncEvery {
+			ph.sync()
+		}
+		if ph.rotation.due(ph.files, ph.opened) {
+			ph.nextSegment(ph.folder)
+		}
+	}
+}
+
+// handle writes a record or processes a rotation or close request. It returns false if the routine has to stop.
+func (ph *PersistenceHandler) handle(item queueItem) bool {
+	switch {
+	case item.close:
+		ph.unspill()
+		ph.flush()
+		ph.closeFiles()
+		if ph.archiveChan != nil {
+			close(ph.archiveChan)
+			<-ph.archived
+		}
+		close(item.done)
+		return false
+	case item.rotate != nil:
+		ph.unspill()
+		ph.flush()
+		ph.naming = item.session
+		ph.nextSegment(*item.rotate)
+		close(item.done)
+	default:
+		ph.seq++
+		item.record.Seq = ph.seq
+		item.record.Hash = chainHash(ph.chain, item.record)
+		ph.chain = item.record.Hash
+		if ph.chainCount == 0 {
+			ph.chainFirst = ph.seq
+		}
+		ph.chainCount++
+		for _, b := range ph.backends {
+			if err := b.Write(item.record); err != nil {
+				fmt.Println(err)
+			}
+		}
+		ph.dirty = true
+		ph.batch = append(ph.batch, item.queued)
+	}
+	return true
+}
+
+// flush writes the buffered records of all backends to their files.
+func (ph *PersistenceHandler) flush() {
+	for _, b := range ph.backends {
+		if err := b.Flush(); err != nil {
 			fmt.Println(err)
 		}
-		ph.writer.Flush()
 	}
+	ph.observeLatency(ph.batch)
+	ph.batch = ph.batch[:0]
 }
 
-// AddEntry adds a message with an identifier to the persistence channel.
-func (ph *PersistenceHandler) AddEntry(id string, msg []byte) {
-	if ph.active {
-		ph.writeChan <- []string{id, string(msg)}
+// sync commits the files of all backends to stable storage.
+func (ph *PersistenceHandler) sync() {
+	for _, b := range ph.backends {
+		if err := b.Sync(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	ph.dirty = false
+	ph.synced = time.Now()
+}
+
+// Close writes all pending records, syncs and closes the files and waits for the archiving of closed segments.
+// Records added afterwards are dropped.
+func (ph *PersistenceHandler) Close() {
+	if !ph.active {
+		return
+	}
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	select {
+	case <-ph.done:
+		return
+	default:
 	}
+	done := make(chan struct{})
+	ph.writeChan <- queueItem{close: true, done: done}
+	<-done
+	close(ph.done)
+}
+
+// AddRecord redacts a record and adds it to the persistence queue, applying the queue policy if it is full. Records
+// without a time are stamped with the current time.
+func (ph *PersistenceHandler) AddRecord(rec Record) {
+	if !ph.active {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Monotonic = rec.Time.Sub(ph.started)
+	if rec.Command == "" {
+		rec.Command = commandName(rec.Data)
+	}
+	ph.redaction.apply(&rec)
+	ph.enqueue(queueItem{record: rec})
+}
+
+// AddEntry adds an inbound message with an identifier to the persistence channel.
+func (ph *PersistenceHandler) AddEntry(id string, msg []byte) {
+	ph.AddRecord(Record{
+		Source:    id,
+		Direction: DirectionIn,
+		Data:      msg,
+	})
 }
@@ -0,0 +1,238 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue policies applied when the persistence queue is full.
+const (
+	// PolicyBlock waits until the queue has room again.
+	PolicyBlock = "block"
+	// PolicyDrop discards the record and counts it.
+	PolicyDrop = "drop"
+	// PolicySpill writes the record to a temporary file, which is fed back in order once the queue has room.
+	PolicySpill = "spill"
+)
+
+// queueCounters holds the counters of the persistence queue. They are updated atomically and kept in a struct of
+// their own to keep the 64 bit alignment atomic operations require.
+type queueCounters struct {
+	written       int64
+	dropped       int64
+	spilled       int64
+	blocked       int64
+	latencySum    int64
+	latencyCount  int64
+	latencyMax    int64
+	latencyLatest int64
+}
+
+// Metrics describes the state of the persistence queue. Latencies are the time in milliseconds from adding a record
+// until it is flushed to the files.
+type Metrics struct {
+	Active        bool    `json:"active"`
+	Policy        string  `json:"policy"`
+	QueueCapacity int     `json:"queue_capacity"`
+	QueueDepth    int     `json:"queue_depth"`
+	SpillDepth    int     `json:"spill_depth"`
+	Written       int64   `json:"written"`
+	Dropped       int64   `json:"dropped"`
+	Spilled       int64   `json:"spilled"`
+	Blocked       int64   `json:"blocked"`
+	LatencyLatest float64 `json:"write_latency_ms"`
+	LatencyAvg    float64 `json:"write_latency_avg_ms"`
+	LatencyMax    float64 `json:"write_latency_max_ms"`
+}
+
+// queueFromEnv reads the queue configuration:
+//
+//	PERSIST_QUEUE_SIZE:   number of records the queue holds, default 1024
+//	PERSIST_QUEUE_POLICY: block, drop or spill when the queue is full, default block
+func queueFromEnv() (int, string) {
+	size := 1024
+	if v := os.Getenv("PERSIST_QUEUE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			fmt.Printf("invalid queue size '%s'\n", v)
+		} else {
+			size = n
+		}
+	}
+	policy := os.Getenv("PERSIST_QUEUE_POLICY")
+	switch policy {
+	case PolicyBlock, PolicyDrop, PolicySpill:
+	case "":
+		policy = PolicyBlock
+	default:
+		fmt.Printf("unknown queue policy '%s'\n", policy)
+		policy = PolicyBlock
+	}
+	return size, policy
+}
+
+// spillFile buffers records in a temporary binary log while the queue is full. Once anything is spilled, following
+// records are spilled as well until the persistence routine took them, so records keep their order.
+type spillFile struct {
+	mu      sync.Mutex
+	backend *binlogBackend
+	name    string
+	queued  []time.Time
+}
+
+// add appends a record to the spill file, creating it if necessary.
+func (s *spillFile) add(rec Record, queued time.Time) error {
+	if s.backend == nil {
+		pattern := "persistence-spill-*.binlog"
+		if ks, _ := currentEncryption(); ks != nil {
+			// Spilled records are encrypted like the persistence files
+			pattern += encryptedExt
+		}
+		f, err := ioutil.TempFile("", pattern)
+		if err != nil {
+			return err
+		}
+		s.name = f.Name()
+		_ = f.Close()
+		s.backend = &binlogBackend{}
+		if err = s.backend.Open(s.name); err != nil {
+			s.backend = nil
+			_ = os.Remove(s.name)
+			return err
+		}
+	}
+	if err := s.backend.Write(rec); err != nil {
+		return err
+	}
+	s.queued = append(s.queued, queued)
+	return nil
+}
+
+// take returns all spilled records with the time they were queued and removes the spill file.
+func (s *spillFile) take() ([]Record, []time.Time, error) {
+	if s.backend == nil {
+		return nil, nil, nil
+	}
+	err := s.backend.Close()
+	var records []Record
+	if err == nil {
+		records, err = readBinlog(s.name)
+	}
+	queued := s.queued
+	_ = os.Remove(s.name)
+	s.backend = nil
+	s.queued = nil
+	return records, queued, err
+}
+
+// enqueue hands a record to the persistence routine according to the queue policy.
+func (ph *PersistenceHandler) enqueue(item queueItem) {
+	item.queued = time.Now()
+	select {
+	case <-ph.done:
+		// Closed, records are not written anymore
+		return
+	default:
+	}
+	if ph.policy == PolicySpill {
+		ph.spill.mu.Lock()
+		defer ph.spill.mu.Unlock()
+		if len(ph.spill.queued) == 0 {
+			select {
+			case ph.writeChan <- item:
+				return
+			case <-ph.done:
+				return
+			default:
+			}
+		}
+		if err := ph.spill.add(item.record, item.queued); err != nil {
+			fmt.Println(err)
+			atomic.AddInt64(&ph.counters.dropped, 1)
+			return
+		}
+		atomic.AddInt64(&ph.counters.spilled, 1)
+		return
+	}
+	select {
+	case ph.writeChan <- item:
+		return
+	case <-ph.done:
+		return
+	default:
+	}
+	if ph.policy == PolicyDrop {
+		atomic.AddInt64(&ph.counters.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&ph.counters.blocked, 1)
+	select {
+	case ph.writeChan <- item:
+	case <-ph.done:
+	}
+}
+
+// unspill writes the spilled records. It is called by the persistence routine after each batch, on every tick and
+// before rotating.
+func (ph *PersistenceHandler) unspill() {
+	if ph.policy != PolicySpill {
+		return
+	}
+	ph.spill.mu.Lock()
+	records, queued, err := ph.spill.take()
+	ph.spill.mu.Unlock()
+	if err != nil {
+		fmt.Printf("Error reading spilled records: %v\n", err)
+	}
+	for i, rec := range records {
+		ph.handle(queueItem{record: rec, queued: queued[i]})
+	}
+}
+
+// observeLatency records the time from queueing to flushing of the records of a batch.
+func (ph *PersistenceHandler) observeLatency(queued []time.Time) {
+	now := time.Now()
+	for _, t := range queued {
+		latency := int64(now.Sub(t))
+		atomic.AddInt64(&ph.counters.latencySum, latency)
+		atomic.AddInt64(&ph.counters.latencyCount, 1)
+		atomic.StoreInt64(&ph.counters.latencyLatest, latency)
+		if latency > atomic.LoadInt64(&ph.counters.latencyMax) {
+			atomic.StoreInt64(&ph.counters.latencyMax, latency)
+		}
+	}
+	atomic.AddInt64(&ph.counters.written, int64(len(queued)))
+}
+
+// Metrics returns the current state of the persistence queue.
+func (ph *PersistenceHandler) Metrics() Metrics {
+	m := Metrics{
+		Active:        ph.active,
+		Policy:        ph.policy,
+		QueueCapacity: cap(ph.writeChan),
+		QueueDepth:    len(ph.writeChan),
+		Written:       atomic.LoadInt64(&ph.counters.written),
+		Dropped:       atomic.LoadInt64(&ph.counters.dropped),
+		Spilled:       atomic.LoadInt64(&ph.counters.spilled),
+		Blocked:       atomic.LoadInt64(&ph.counters.blocked),
+		LatencyLatest: milliseconds(atomic.LoadInt64(&ph.counters.latencyLatest)),
+		LatencyMax:    milliseconds(atomic.LoadInt64(&ph.counters.latencyMax)),
+	}
+	if n := atomic.LoadInt64(&ph.counters.latencyCount); n > 0 {
+		m.LatencyAvg = milliseconds(atomic.LoadInt64(&ph.counters.latencySum) / n)
+	}
+	ph.spill.mu.Lock()
+	m.SpillDepth = len(ph.spill.queued)
+	ph.spill.mu.Unlock()
+	return m
+}
+
+// milliseconds converts nanoseconds to fractional milliseconds.
+func milliseconds(ns int64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
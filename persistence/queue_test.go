@@ -0,0 +1,103 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHandler creates an active PersistenceHandler writing JSON Lines into a temporary folder. The persistence
+// routine is not started yet.
+func testHandler(t *testing.T, policy string, size int) *PersistenceHandler {
+	dir := t.TempDir()
+	t.Setenv("PERSIST_FOLDER", dir)
+	t.Setenv("PERSIST_PATTERN", "events")
+	ph := &PersistenceHandler{
+		active:    true,
+		started:   time.Now(),
+		done:      make(chan struct{}),
+		chains:    make(map[string][]ChainSegment),
+		backends:  []Backend{&jsonlBackend{}},
+		syncEvery: 10 * time.Millisecond,
+		policy:    policy,
+		writeChan: make(chan queueItem, size),
+	}
+	ph.openFiles(dir)
+	return ph
+}
+
+// checkOrder checks that the records of a file hold the numbers from 1 to n in order with consecutive sequence
+// numbers.
+func checkOrder(t *testing.T, path string, n int) {
+	t.Helper()
+	records, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != n {
+		t.Fatalf("got %d records, want %d", len(records), n)
+	}
+	for i, rec := range records {
+		if string(rec.Data) != fmt.Sprint(i+1) || rec.Seq != uint64(i+1) {
+			t.Errorf("record %d: got seq %d with %s", i+1, rec.Seq, rec.Data)
+		}
+	}
+}
+
+func TestQueuePolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy  string
+		written int
+		dropped int64
+		spilled int64
+	}{
+		{PolicyDrop, 1, 4, 0},
+		{PolicySpill, 5, 0, 4},
+		{PolicyBlock, 5, 0, 0},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			ph := testHandler(t, test.policy, 1)
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 1; i <= 5; i++ {
+					ph.AddRecord(Record{Source: "client", Data: []byte(fmt.Sprint(i))})
+				}
+			}()
+			// Fill the queue before the records are taken, blocking needs the persistence routine to proceed
+			if test.policy != PolicyBlock {
+				wg.Wait()
+			}
+			go ph.persistRoutine()
+			wg.Wait()
+			ph.Close()
+			checkOrder(t, ph.files[0], test.written)
+			m := ph.Metrics()
+			if m.Written != int64(test.written) || m.Dropped != test.dropped || m.Spilled != test.spilled {
+				t.Errorf("got metrics %+v", m)
+			}
+			if m.SpillDepth != 0 {
+				t.Errorf("%d records left in the spill file", m.SpillDepth)
+			}
+		})
+	}
+}
+
+func TestUnspillOnTick(t *testing.T) {
+	ph := testHandler(t, PolicySpill, 1)
+	// The queue was drained before the record got spilled, nothing else is queued
+	if err := ph.spill.add(Record{Source: "client", Data: []byte("1")}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	go ph.persistRoutine()
+	defer ph.Close()
+	for deadline := time.Now().Add(time.Second); ph.Metrics().Written == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("spilled record was not written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkOrder(t, ph.files[0], 1)
+}
@@ -0,0 +1,86 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// recoverFolder recovers the uncompressed persistence files within a folder and its session directories.
+func recoverFolder(folder string) {
+	if folder == "" {
+		folder = "."
+	}
+	dirs, _ := filepath.Glob(filepath.Join(folder, "session_*"))
+	for _, dir := range append([]string{folder}, dirs...) {
+		for _, format := range formats {
+			files, _ := filepath.Glob(filepath.Join(dir, "*"+format.create().Extension()))
+			for _, file := range files {
+				n, err := format.recover(file)
+				if err != nil {
+					fmt.Printf("Error recovering '%s': %v\n", file, err)
+				} else if n > 0 {
+					fmt.Printf("Recovered '%s': removed torn last record of %d bytes\n", file, n)
+				}
+			}
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+encryptedExt))
+		for _, file := range files {
+			n, err := recoverEncrypted(file)
+			if err != nil {
+				fmt.Printf("Error recovering '%s': %v\n", file, err)
+			} else if n > 0 {
+				fmt.Printf("Recovered '%s': removed torn last chunk of %d bytes\n", file, n)
+			}
+		}
+	}
+}
+
+// recoverLines truncates a line-based file after its last complete line.
+func recoverLines(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 || data[len(data)-1] == '\n' {
+		return 0, err
+	}
+	end := int64(bytes.LastIndexByte(data, '\n') + 1)
+	return int64(len(data)) - end, os.Truncate(path, end)
+}
+
+// recoverBinlog truncates a binary log after its last complete record.
+func recoverBinlog(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return 0, err
+	}
+	size := info.Size()
+	end := int64(len(binlogMagic))
+	length := make([]byte, 4)
+	for end < size {
+		if _, err = f.ReadAt(length, end); err != nil && err != io.EOF {
+			_ = f.Close()
+			return 0, err
+		}
+		next := end + 4 + int64(binary.BigEndian.Uint32(length))
+		if err == io.EOF || next > size {
+			break
+		}
+		end = next
+	}
+	_ = f.Close()
+	if size < int64(len(binlogMagic)) {
+		// Torn magic, the file is rewritten on its next use
+		end = 0
+	} else if end >= size {
+		return 0, nil
+	}
+	return size - end, os.Truncate(path, end)
+}
@@ -0,0 +1,92 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRecords returns n hash-chained inbound records.
+func testRecords(n int) []Record {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	records := make([]Record, n)
+	prev := ""
+	for i := range records {
+		records[i] = Record{
+			Seq:       uint64(i + 1),
+			Time:      start.Add(time.Duration(i) * time.Millisecond),
+			Monotonic: time.Duration(i) * time.Millisecond,
+			Source:    "127.0.0.1:51000",
+			Command:   "msg",
+			Direction: DirectionIn,
+			Data:      []byte(fmt.Sprintf(`[["msg",{"text":"record %d"}]]`, i+1)),
+		}
+		records[i].Hash = chainHash(prev, records[i])
+		prev = records[i].Hash
+	}
+	return records
+}
+
+// writeRecords writes records with a backend into a file.
+func writeRecords(t *testing.T, backend string, path string, records []Record) {
+	t.Helper()
+	b, err := NewBackend(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err = b.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkRecords compares records read back with the written ones.
+func checkRecords(t *testing.T, got []Record, want []Record) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Seq != w.Seq || !g.Time.Equal(w.Time) || g.Monotonic != w.Monotonic || g.Source != w.Source ||
+			g.Command != w.Command || g.Topic != w.Topic || g.Direction != w.Direction ||
+			string(g.Data) != string(w.Data) || g.Hash != w.Hash {
+			t.Errorf("record %d: got %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestRecoverTornRecord(t *testing.T) {
+	for _, backend := range []string{"csv", "jsonl", "binlog"} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			b, _ := NewBackend(backend)
+			path := filepath.Join(dir, "events"+b.Extension())
+			records := testRecords(3)
+			writeRecords(t, backend, path, records)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A crash in the middle of the last record
+			if err = os.Truncate(path, info.Size()-5); err != nil {
+				t.Fatal(err)
+			}
+			recoverFolder(dir)
+			got, err := ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRecords(t, got, records[:2])
+		})
+	}
+}
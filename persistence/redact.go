@@ -0,0 +1,286 @@
+package persistence
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// Address redaction modes.
+const (
+	// AddressKeep persists client addresses as they are.
+	AddressKeep = "keep"
+	// AddressHash replaces the IP of client addresses by a keyed hash, keeping the port.
+	AddressHash = "hash"
+	// AddressReplace replaces the IP of client addresses by "client", keeping the port.
+	AddressReplace = "replace"
+)
+
+// masked replaces the values of masked payload keys.
+const masked = "***"
+
+// redaction removes personal data from records before they are persisted. Payload keys are matched by name at any
+// depth or by their dotted path within the payload, e.g. "metadata.name".
+type redaction struct {
+	addresses  string
+	drop       map[string]bool
+	mask       map[string]bool
+	pseudonyms map[string]bool
+	key        []byte
+}
+
+// redactionFromEnv reads the redaction configuration:
+//
+//	PERSIST_REDACT_ADDRESSES: keep, hash or replace client IP addresses, default keep
+//	PERSIST_REDACT_DROP:      comma separated payload keys to remove
+//	PERSIST_REDACT_MASK:      comma separated payload keys to mask
+//	PERSIST_PSEUDONYM_KEY:    key file to derive pseudonyms and address hashes from, generated if missing
+//	PERSIST_PSEUDONYM_KEYS:   comma separated payload keys holding participant ids, default participant
+func redactionFromEnv() redaction {
+	r := redaction{
+		addresses:  os.Getenv("PERSIST_REDACT_ADDRESSES"),
+		drop:       keySet(os.Getenv("PERSIST_REDACT_DROP")),
+		mask:       keySet(os.Getenv("PERSIST_REDACT_MASK")),
+		pseudonyms: make(map[string]bool),
+	}
+	switch r.addresses {
+	case AddressKeep, AddressHash, AddressReplace:
+	case "":
+		r.addresses = AddressKeep
+	default:
+		fmt.Printf("unknown address redaction '%s'\n", r.addresses)
+		r.addresses = AddressKeep
+	}
+	if path := os.Getenv("PERSIST_PSEUDONYM_KEY"); path != "" {
+		key, err := loadPseudonymKey(path)
+		if err != nil {
+			fmt.Println(err)
+		}
+		r.key = key
+	}
+	if r.key != nil {
+		names := os.Getenv("PERSIST_PSEUDONYM_KEYS")
+		if names == "" {
+			names = "participant"
+		}
+		r.pseudonyms = keySet(names)
+	}
+	if r.addresses == AddressHash && r.key == nil {
+		fmt.Println("No pseudonym key configured, address hashes differ between broker runs")
+		r.key = make([]byte, 32)
+		_, _ = rand.Read(r.key)
+	}
+	return r
+}
+
+// keySet splits a comma separated list of payload keys.
+func keySet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			set[key] = true
+		}
+	}
+	return set
+}
+
+// loadPseudonymKey reads a base64 encoded key. If the file does not exist, a new random key is generated.
+func loadPseudonymKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Generated pseudonym key '%s'\n", path)
+		return key, ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < 16 {
+		return nil, fmt.Errorf("'%s' is no pseudonym key", path)
+	}
+	return key, nil
+}
+
+// active reports if any redaction is configured.
+func (r *redaction) active() bool {
+	return r.addresses != AddressKeep || len(r.drop) > 0 || len(r.mask) > 0 || len(r.pseudonyms) > 0
+}
+
+// keyedLength is the number of hex digits of keyed hashes.
+const keyedLength = 12
+
+// pseudonymPrefix starts every pseudonym.
+const pseudonymPrefix = "P-"
+
+// keyed returns a short hex encoded HMAC of a value.
+func (r *redaction) keyed(value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:keyedLength]
+}
+
+// pseudonym maps a participant id to its pseudonym. Without pseudonym key, the id is returned as is, as are
+// pseudonyms, e.g. the participant of a session echoed in a command, even from an earlier broker run.
+func (r *redaction) pseudonym(id string) string {
+	if len(r.pseudonyms) == 0 || id == "" || isPseudonym(id) {
+		return id
+	}
+	return pseudonymPrefix + r.keyed("participant:"+id)
+}
+
+// isPseudonym reports if an id has the format of a pseudonym: the prefix followed by lowercase hex digits.
+func isPseudonym(id string) bool {
+	return strings.HasPrefix(id, pseudonymPrefix) && isKeyed(id[len(pseudonymPrefix):])
+}
+
+// isKeyed reports if a value has the format of a keyed hash: lowercase hex digits of the keyed length.
+func isKeyed(s string) bool {
+	if len(s) != keyedLength {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsClientSource reports if the source of a record is a client address, as it is or redacted, rather than the broker
+// or a sensor.
+func IsClientSource(source string) bool {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+	return net.ParseIP(host) != nil || isKeyed(host) || host == "client"
+}
+
+// address redacts the IP of a client address "ip:port" or a bare IP. Other values are returned as is.
+func (r *redaction) address(s string) string {
+	if r.addresses == AddressKeep {
+		return s
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, ""
+	}
+	if net.ParseIP(host) == nil {
+		return s
+	}
+	if r.addresses == AddressHash {
+		host = r.keyed("address:" + host)
+	} else {
+		host = "client"
+	}
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+// apply redacts the source, the topic, which holds the client address of responses, and the json data of a record.
+// Data that is no json object is left untouched, as are records nothing was redacted from.
+func (r *redaction) apply(rec *Record) {
+	if !r.active() {
+		return
+	}
+	rec.Source = r.address(rec.Source)
+	rec.Topic = r.address(rec.Topic)
+	decoder := json.NewDecoder(bytes.NewReader(rec.Data))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if decoder.Decode(&doc) != nil {
+		return
+	}
+	payload, found := doc["payload"]
+	if !found {
+		return
+	}
+	redacted, changed := r.value(payload, "", "")
+	if !changed {
+		return
+	}
+	doc["payload"] = redacted
+	if data, err := json.Marshal(doc); err == nil {
+		rec.Data = data
+	}
+}
+
+// metadata returns a redacted copy of session metadata, whose keys are matched with the prefix "metadata".
+func (r *redaction) metadata(m map[string]interface{}) map[string]interface{} {
+	if m == nil || !r.active() {
+		return m
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return m
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var clone map[string]interface{}
+	if decoder.Decode(&clone) != nil {
+		return m
+	}
+	r.value(clone, "metadata", "metadata")
+	return clone
+}
+
+// value redacts a json value found under a key and dotted path. It returns the redacted value and whether anything
+// changed.
+func (r *redaction) value(v interface{}, key string, path string) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		changed := false
+		for k, child := range v {
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			if r.drop[k] || r.drop[childPath] {
+				delete(v, k)
+				changed = true
+				continue
+			}
+			if r.mask[k] || r.mask[childPath] {
+				v[k] = masked
+				changed = true
+				continue
+			}
+			if redacted, c := r.value(child, k, childPath); c {
+				v[k] = redacted
+				changed = true
+			}
+		}
+		return v, changed
+	case []interface{}:
+		changed := false
+		for i, child := range v {
+			if redacted, c := r.value(child, key, path); c {
+				v[i] = redacted
+				changed = true
+			}
+		}
+		return v, changed
+	case string:
+		redacted := r.address(v)
+		if r.pseudonyms[key] || r.pseudonyms[path] {
+			redacted = r.pseudonym(v)
+		}
+		return redacted, redacted != v
+	}
+	return v, false
+}
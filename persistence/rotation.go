@@ -0,0 +1,209 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{[a-z]+\}`)
+
+// rotation configures when a segment, i.e. the set of files currently written by the backends, is closed and what
+// happens to closed segments.
+type rotation struct {
+	size     int64
+	interval time.Duration
+	compress string
+	keep     int
+	maxAge   time.Duration
+}
+
+// archiveJob describes a closed segment to compress and a folder to prune afterwards.
+type archiveJob struct {
+	files   []string
+	folder  string
+	current string
+}
+
+// rotationFromEnv reads the rotation configuration:
+//
+//	PERSIST_ROTATE_SIZE:     rotate when a file reaches a size, e.g. 500KB, 100MB or 1GB
+//	PERSIST_ROTATE_INTERVAL: rotate after a duration, e.g. 30m
+//	PERSIST_COMPRESS:        compress closed segments with gzip or zstd
+//	PERSIST_RETENTION_COUNT: keep only the newest segments in a folder
+//	PERSIST_RETENTION_AGE:   remove segments older than a duration, e.g. 720h
+func rotationFromEnv() rotation {
+	r := rotation{}
+	var err error
+	if v := os.Getenv("PERSIST_ROTATE_SIZE"); v != "" {
+		if r.size, err = parseSize(v); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if v := os.Getenv("PERSIST_ROTATE_INTERVAL"); v != "" {
+		if r.interval, err = time.ParseDuration(v); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if v := os.Getenv("PERSIST_COMPRESS"); v != "" && v != "none" {
+		if _, found := compressions[v]; found {
+			r.compress = v
+		} else {
+			fmt.Printf("unknown compression '%s'\n", v)
+		}
+	}
+	if v := os.Getenv("PERSIST_RETENTION_COUNT"); v != "" {
+		if r.keep, err = strconv.Atoi(v); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if v := os.Getenv("PERSIST_RETENTION_AGE"); v != "" {
+		if r.maxAge, err = time.ParseDuration(v); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return r
+}
+
+// parseSize parses a size in bytes with an optional unit KB, MB or GB.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for unit, f := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit))
+			factor = f
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(s, "B"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * factor, nil
+}
+
+// due reports if a segment has to be rotated because of its size or age.
+func (r rotation) due(files []string, opened time.Time) bool {
+	if r.interval > 0 && time.Since(opened) >= r.interval {
+		return true
+	}
+	if r.size > 0 {
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil && info.Size() >= r.size {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// archives reports if closed segments have to be processed at all.
+func (r rotation) archives() bool {
+	return r.compress != "" || r.keep > 0 || r.maxAge > 0
+}
+
+// archiveRoutine compresses closed segments and prunes old segments.
+func (ph *PersistenceHandler) archiveRoutine() {
+	for job := range ph.archiveChan {
+		if ph.rotation.compress != "" {
+			for _, file := range job.files {
+				if err := compressFile(file, ph.rotation.compress); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+		ph.prune(job.folder, job.current)
+	}
+	close(ph.archived)
+}
+
+// prune removes the segments in a folder exceeding the retention count or age. Segments are identified by the
+// persistence pattern; the current segment, if within the folder, is never removed.
+func (ph *PersistenceHandler) prune(folder string, current string) {
+	if ph.rotation.keep <= 0 && ph.rotation.maxAge <= 0 {
+		return
+	}
+	pattern := placeholderPattern.ReplaceAllString(filePattern(), "*")
+	matches, err := filepath.Glob(filepath.Join(folder, pattern+"*"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	segments := make(map[string][]string)
+	modified := make(map[string]time.Time)
+	for _, file := range matches {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		stem := segmentStem(file)
+		if stem == current {
+			continue
+		}
+		segments[stem] = append(segments[stem], file)
+		if info.ModTime().After(modified[stem]) {
+			modified[stem] = info.ModTime()
+		}
+	}
+	stems := make([]string, 0, len(segments))
+	for stem := range segments {
+		stems = append(stems, stem)
+	}
+	sort.Slice(stems, func(i, j int) bool {
+		return modified[stems[i]].After(modified[stems[j]])
+	})
+	kept := 0
+	if current != "" {
+		// The current segment counts towards the kept segments
+		kept = 1
+	}
+	for i, stem := range stems {
+		expired := ph.rotation.keep > 0 && i+kept >= ph.rotation.keep
+		expired = expired || (ph.rotation.maxAge > 0 && time.Since(modified[stem]) > ph.rotation.maxAge)
+		if !expired {
+			continue
+		}
+		for _, file := range segments[stem] {
+			if err := os.Remove(file); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// SegmentName returns the name of the segment a persistence file belongs to, i.e. its base name without compression,
+// encryption and backend extension. All backend files written at the same time share a segment name.
+func SegmentName(file string) string {
+	return filepath.Base(segmentStem(file))
+}
+
+// segmentStem returns a file name without compression, encryption and backend extension.
+func segmentStem(file string) string {
+	ext := filepath.Ext(file)
+	for _, e := range compressions {
+		if e == ext {
+			file = strings.TrimSuffix(file, ext)
+			ext = filepath.Ext(file)
+		}
+	}
+	if ext == encryptedExt {
+		file = strings.TrimSuffix(file, ext)
+		ext = filepath.Ext(file)
+	}
+	for _, format := range formats {
+		if format.create().Extension() == ext {
+			return strings.TrimSuffix(file, ext)
+		}
+	}
+	// SQLite side files like .db-wal
+	if i := strings.LastIndex(file, ".db-"); i >= 0 {
+		return file[:i]
+	}
+	return file
+}
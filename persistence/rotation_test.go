@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotation(t *testing.T) {
+	for method, ext := range compressions {
+		t.Run(method, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("PERSIST_EVENTS", "true")
+			t.Setenv("PERSIST_FOLDER", dir)
+			t.Setenv("PERSIST_BACKENDS", "csv")
+			t.Setenv("PERSIST_PATTERN", "events_{seq}")
+			t.Setenv("PERSIST_FSYNC_INTERVAL", "10ms")
+			t.Setenv("PERSIST_ROTATE_SIZE", "1KB")
+			t.Setenv("PERSIST_COMPRESS", method)
+			t.Setenv("PERSIST_RETENTION_COUNT", "3")
+			ph := NewPersistenceHandler()
+			// Groups of records exceeding the rotation size, each written before the next is added
+			for i := 1; i <= 100; i++ {
+				ph.AddRecord(Record{Source: "client", Data: []byte(fmt.Sprintf(`[["msg",{"text":"record %d"}]]`, i))})
+				for deadline := time.Now().Add(time.Second); i%10 == 0 && ph.Metrics().Written < int64(i); {
+					if time.Now().After(deadline) {
+						t.Fatalf("record %d was not written", i)
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+			ph.Close()
+
+			files, err := filepath.Glob(filepath.Join(dir, "events_*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(files)
+			if len(files) != 3 {
+				t.Fatalf("got files %v, want the current and two archived segments", files)
+			}
+			var records []Record
+			for i, file := range files {
+				if compressed := strings.HasSuffix(file, ".csv"+ext); compressed != (i < len(files)-1) {
+					t.Errorf("'%s' is not compressed as expected", file)
+				}
+				read, err := ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				records = append(records, read...)
+			}
+			if len(records) == 0 || records[len(records)-1].Seq != 100 {
+				t.Fatalf("got %d records, the newest segments have to be kept", len(records))
+			}
+			for i := 1; i < len(records); i++ {
+				if records[i].Seq != records[i-1].Seq+1 {
+					t.Errorf("record %d follows record %d", records[i].Seq, records[i-1].Seq)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// ManifestName is the file name of the session manifest within a session directory.
+const ManifestName = "manifest.json"
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Session describes a recording session. While a session is running, all entries are persisted into a dedicated
+// session directory, which also holds the session manifest.
+type Session struct {
+	ID            string                 `json:"id"`
+	Participant   string                 `json:"participant"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	Start         time.Time              `json:"start"`
+	End           *time.Time             `json:"end,omitempty"`
+	Clients       []string               `json:"clients,omitempty"`
+	Config        map[string]string      `json:"config,omitempty"`
+	BrokerVersion string                 `json:"broker_version"`
+	Directory     string                 `json:"directory"`
+	Segments      []ChainSegment         `json:"segments,omitempty"`
+	FinalHash     string                 `json:"final_hash,omitempty"`
+	Signature     string                 `json:"signature,omitempty"`
+	PublicKey     string                 `json:"public_key,omitempty"`
+}
+
+// StartSession starts a session and rotates the persistence output into the session directory. The session's ID,
+// start time and directory are set by the handler. With pseudonymization, the participant is replaced by its
+// pseudonym, and the metadata is redacted.
+func (ph *PersistenceHandler) StartSession(s *Session) error {
+	if s.Participant == "" {
+		return fmt.Errorf("missing participant id")
+	}
+	if running := ph.Session(); running != nil {
+		return fmt.Errorf("session '%s' is still running", running.ID)
+	}
+	if ph.active {
+		s.Participant = ph.redaction.pseudonym(s.Participant)
+		s.Metadata = ph.redaction.metadata(s.Metadata)
+	}
+	s.Start = time.Now()
+	s.ID = s.Start.Format("20060102-150405") + "_" + unsafeChars.ReplaceAllString(s.Participant, "_")
+	s.Directory = filepath.Join(baseFolder(), "session_"+s.ID)
+	if ph.active {
+		if err := os.MkdirAll(s.Directory, 0755); err != nil {
+			return err
+		}
+		if err := writeManifest(s); err != nil {
+			return err
+		}
+		ph.rotate(s.Directory, s)
+	}
+	ph.mu.Lock()
+	ph.session = s
+	ph.mu.Unlock()
+	return nil
+}
+
+// EndSession ends the running session, rotates the persistence output back to the persistence folder and completes
+// its manifest with the end time, the session's clients and the hash chains of its segments. The manifest is signed
+// if a signing key is configured.
+func (ph *PersistenceHandler) EndSession(clients []string) (*Session, error) {
+	ph.mu.Lock()
+	s := ph.session
+	ph.session = nil
+	ph.mu.Unlock()
+	if s == nil {
+		return nil, fmt.Errorf("no session running")
+	}
+	end := time.Now()
+	s.End = &end
+	s.Clients = clients
+	if ph.active {
+		for i, client := range s.Clients {
+			s.Clients[i] = ph.redaction.address(client)
+		}
+		ph.rotate(baseFolder(), nil)
+		s.Segments = ph.takeChains(s.Directory)
+		if n := len(s.Segments); n > 0 {
+			s.FinalHash = s.Segments[n-1].FinalHash
+		}
+		if ph.signingKey != nil {
+			if err := s.sign(ph.signingKey); err != nil {
+				return s, err
+			}
+		}
+		if err := writeManifest(s); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// Session returns the running session or nil, if no session is running.
+func (ph *PersistenceHandler) Session() *Session {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	return ph.session
+}
+
+// writeManifest writes the manifest of a session into its directory. If persistence files are encrypted, so is the
+// manifest.
+func writeManifest(s *Session) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	ks, err := currentEncryption()
+	if err != nil {
+		return err
+	}
+	if ks == nil {
+		return ioutil.WriteFile(filepath.Join(s.Directory, ManifestName), data, 0644)
+	}
+	name := filepath.Join(s.Directory, ManifestName+encryptedExt)
+	if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := createFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ManifestPath returns the manifest of a session directory, encrypted or plain, or "" if there is none.
+func ManifestPath(dir string) string {
+	for _, name := range []string{ManifestName + encryptedExt, ManifestName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return ""
+}
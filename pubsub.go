@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net"
+	"sort"
 	"sync"
 )
 
@@ -16,12 +17,15 @@ type UdpClient struct {
 	Chan chan []byte
 }
 
-// Pubsub describes a publish/subscribe broker with different topics to subscribe on.
+// Pubsub describes a publish/subscribe broker with different topics to subscribe on. The Publish loop reads the
+// subscribers of all topics from a list guarded by topicsMu, as it must not wait for mu while publishers hold it.
 type Pubsub struct {
-	nm     *NetworkMgr
-	mu     sync.Mutex
-	subs   map[string]*sync.Map
-	closed bool
+	nm        *NetworkMgr
+	mu        sync.Mutex
+	subs      map[string]*sync.Map
+	topicsMu  sync.RWMutex
+	topicList []*sync.Map
+	closed    bool
 }
 
 // NewPubsub creates a new Pubsub.
@@ -38,6 +42,10 @@ func (ps *Pubsub) Subscribe(topic string, addr *net.UDPAddr) {
 	defer ps.mu.Unlock()
 	if ps.subs[topic] == nil {
 		ps.subs[topic] = &sync.Map{}
+		// Replace the list, so the Publish loop can keep iterating the old one
+		ps.topicsMu.Lock()
+		ps.topicList = append(ps.topicList[:len(ps.topicList):len(ps.topicList)], ps.subs[topic])
+		ps.topicsMu.Unlock()
 	}
 	s := addr.String()
 	if _, ok := ps.subs[topic].Load(s); !ok {
@@ -59,6 +67,38 @@ func (ps *Pubsub) Unsubscribe(topic string, addr *net.UDPAddr) {
 	_, _ = ps.subs[topic].LoadAndDelete(s)
 }
 
+// UnsubscribeAll unsubscribes a client from all topics.
+func (ps *Pubsub) UnsubscribeAll(addr *net.UDPAddr) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s := addr.String()
+	for _, clients := range ps.subs {
+		_, _ = clients.LoadAndDelete(s)
+	}
+}
+
+// Topics returns the topics a client is subscribed to.
+func (ps *Pubsub) Topics(addr *net.UDPAddr) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	s := addr.String()
+	var topics []string
+	for topic, clients := range ps.subs {
+		if _, found := clients.Load(s); found {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// topics returns the subscribers of all topics.
+func (ps *Pubsub) topics() []*sync.Map {
+	ps.topicsMu.RLock()
+	defer ps.topicsMu.RUnlock()
+	return ps.topicList
+}
+
 // Publish a message to a topic.
 func (ps *Pubsub) Publish(topic string, msg []byte) {
 	ps.PublishWithOptions(topic, msg, PlainMode)
@@ -78,6 +118,9 @@ func (ps *Pubsub) PublishWithOptions(topic string, msg []byte, plain bool) {
 		}
 		msg = data
 	}
+	if ps.subs[topic] == nil {
+		return
+	}
 	ps.subs[topic].Range(func(k interface{}, client interface{}) bool {
 		client.(*UdpClient).Chan <- msg
 		return true
@@ -103,7 +146,13 @@ func (ps *Pubsub) UnicastWithOptions(addr *net.UDPAddr, msg []byte, plain bool)
 		}
 		msg = data
 	}
-	client, _ := ps.subs[PubSubTopicBasic].Load(addr.String())
+	if ps.subs[PubSubTopicBasic] == nil {
+		return
+	}
+	client, found := ps.subs[PubSubTopicBasic].Load(addr.String())
+	if !found {
+		return
+	}
 	client.(*UdpClient).Chan <- msg
 }
 
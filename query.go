@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"viveSyncBroker/inspect"
+)
+
+// queryRequest is a query over persisted files, either listing the matching entries or aggregating them.
+type queryRequest struct {
+	query     inspect.Query
+	aggregate bool
+	group     []string
+	value     string
+	format    string
+}
+
+// newQueryRequest builds a query from the textual parameters shared by the query subcommand and the HTTP endpoint.
+// Durations in from and to are relative to now, e.g. "-10m" for the last ten minutes.
+func newQueryRequest(sources, commands, from, to string, where []string) (queryRequest, error) {
+	qr := queryRequest{format: "text"}
+	qr.query.Sources = splitList(sources)
+	qr.query.Commands = splitList(commands)
+	now := time.Now()
+	var err error
+	if qr.query.From, err = inspect.ParseTime(from, now); err != nil {
+		return qr, err
+	}
+	if qr.query.To, err = inspect.ParseTime(to, now); err != nil {
+		return qr, err
+	}
+	for _, w := range where {
+		qr.query.Conditions = append(qr.query.Conditions, inspect.ParseCondition(w))
+	}
+	return qr, nil
+}
+
+// check validates the aggregation parameters before any output is written.
+func (qr queryRequest) check() error {
+	if !qr.aggregate {
+		return nil
+	}
+	if qr.format != "text" && qr.format != "jsonl" {
+		return fmt.Errorf("unknown format '%s'", qr.format)
+	}
+	_, err := inspect.NewAggregator(qr.group, qr.value)
+	return err
+}
+
+// write runs the query over the files and writes the matching entries as JSON Lines while they are read, or the
+// aggregates once all files are read. Read errors are returned after the output of the records that could be read.
+// flush is called whenever output should reach the reader.
+func (qr queryRequest) write(w io.Writer, files []string, flush func()) error {
+	if !qr.aggregate {
+		n := 0
+		err := qr.query.Run(files, func(e inspect.Entry) error {
+			if n++; n%100 == 0 {
+				flush()
+			}
+			return inspect.WriteJSONL(w, []inspect.Entry{e})
+		})
+		flush()
+		return err
+	}
+	aggregator, err := inspect.NewAggregator(qr.group, qr.value)
+	if err != nil {
+		return err
+	}
+	runErr := qr.query.Run(files, func(e inspect.Entry) error {
+		aggregator.Add(e)
+		return nil
+	})
+	results := aggregator.Results()
+	switch qr.format {
+	case "jsonl":
+		encoder := json.NewEncoder(w)
+		for _, a := range results {
+			if err = encoder.Encode(a); err != nil {
+				return err
+			}
+		}
+	default:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "Source\tCommand\tCount\tFirst\tLast\tRate\tFirst value\tLast value\n")
+		for _, a := range results {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%.2f/s\t%s\t%s\n", a.Source, a.Command, a.Count,
+				a.First.Format(time.RFC3339Nano), a.Last.Format(time.RFC3339Nano), a.Rate,
+				inspect.FormatValue(a.FirstValue), inspect.FormatValue(a.LastValue))
+		}
+		err = tw.Flush()
+	}
+	flush()
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// QuerySubcommand queries persistence files or folders, including their session directories.
+func QuerySubcommand(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	sources := fs.String("source", "", "comma separated sources")
+	commands := fs.String("command", "", "comma separated commands")
+	from := fs.String("from", "", "start of the time range, RFC 3339 or duration relative to now")
+	to := fs.String("to", "", "end of the time range, RFC 3339 or duration relative to now")
+	var where listFlag
+	fs.Var(&where, "where", "payload condition path or path=value, repeatable")
+	aggregate := fs.Bool("aggregate", false, "print counts, rates and first/last value instead of the entries")
+	group := fs.String("group", "source,command", "comma separated columns to aggregate by: source, command")
+	value := fs.String("value", "", "payload path of the first and last value of the aggregates")
+	format := fs.String("format", "text", "aggregate format: text or jsonl")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		usage()
+		return fmt.Errorf("expected at least one file or folder")
+	}
+	qr, err := newQueryRequest(*sources, *commands, *from, *to, where)
+	if err != nil {
+		return err
+	}
+	qr.aggregate, qr.group, qr.value, qr.format = *aggregate, splitList(*group), *value, *format
+	if err = qr.check(); err != nil {
+		return err
+	}
+	var files []string
+	for _, arg := range fs.Args() {
+		found, err := inspect.Files(arg)
+		if err != nil {
+			return err
+		}
+		files = append(files, found...)
+	}
+	return qr.write(os.Stdout, files, func() {})
+}
+
+// setupQueryServer starts the HTTP query endpoint on QUERY_ADDRESS, e.g. "127.0.0.1:8398", if configured. It
+// answers GET /query over the files in PERSIST_FOLDER with the parameters of the query subcommand; "where" may be
+// repeated and "path" selects a file or subfolder.
+func setupQueryServer() error {
+	address := os.Getenv("QUERY_ADDRESS")
+	if address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", QueryHandler)
+	fmt.Printf("Query endpoint on http://%s/query\n", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	return nil
+}
+
+// QueryHandler answers queries over HTTP. Entries are streamed as they are read; errors after the first entry are
+// reported as a final json line with an "error" key.
+func QueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	qr, err := newQueryRequest(params.Get("source"), params.Get("command"), params.Get("from"), params.Get("to"),
+		params["where"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qr.aggregate = params.Get("aggregate") == "true" || params.Get("aggregate") == "1"
+	qr.group = splitList(params.Get("group"))
+	if _, found := params["group"]; !found {
+		qr.group = []string{"source", "command"}
+	}
+	qr.value = params.Get("value")
+	if format := params.Get("format"); format != "" {
+		qr.format = format
+	}
+	if err = qr.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only files within the persistence folder can be queried
+	files, err := inspect.Files(filepath.Join(os.Getenv("PERSIST_FOLDER"), filepath.Clean("/"+params.Get("path"))))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !qr.aggregate || qr.format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	flusher, _ := w.(http.Flusher)
+	if err = qr.write(w, files, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}); err != nil {
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		_, _ = w.Write(append(data, '\n'))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"viveSyncBroker/replay"
+)
+
+var (
+	player *replay.Player
+)
+
+// setupReplay loads the recording configured through REPLAY_FILE. The playback is started with a "replay" command.
+func setupReplay(ch *CommandHandler) error {
+	file := os.Getenv("REPLAY_FILE")
+	if file == "" {
+		return nil
+	}
+	return loadReplay(ch, file, replay.Filter{})
+}
+
+// loadReplay replaces the current Player with a new one for a recording. Replayed Commands are broadcast as they were
+// recorded and are not persisted again.
+func loadReplay(ch *CommandHandler, file string, filter replay.Filter) error {
+	p, err := replay.Load(file, filter)
+	if err != nil {
+		return err
+	}
+	p.Emit = func(ev replay.Event) {
+		ch.nm.Pubsub.Publish(PubSubTopicBasic, ev.Data)
+	}
+	if player != nil {
+		player.Stop()
+	}
+	player = p
+	return nil
+}
+
+// ReplayCommand is the Command for "replay". The payload's "action" controls the playback:
+//
+//	load:   load the recording "file" (relative to PERSIST_FOLDER), optionally filtered by "sources" and "commands";
+//	        only client Commands are replayed unless "all" is true
+//	play:   start or resume the playback
+//	pause:  pause the playback
+//	seek:   move the playback to "position" seconds from the start of the recording
+//	speed:  set the playback "speed" (0.5 - 10)
+//	stop:   stop the playback and unload the recording
+//	status: respond with the playback state
+func ReplayCommand(com *Command, ch *CommandHandler) error {
+	action, _ := com.Payload["action"].(string)
+	if action == "load" {
+		file, _ := com.Payload["file"].(string)
+		all, _ := com.Payload["all"].(bool)
+		filter := replay.Filter{
+			Sources:  stringList(com.Payload["sources"]),
+			Commands: stringList(com.Payload["commands"]),
+			All:      all,
+		}
+		// Only recordings within the persistence folder can be loaded
+		file = filepath.Join(os.Getenv("PERSIST_FOLDER"), filepath.Clean("/"+file))
+		if err := loadReplay(ch, file, filter); err != nil {
+			ch.RespondError(com, err)
+			return nil
+		}
+	} else if player == nil {
+		ch.RespondError(com, fmt.Errorf("no recording loaded"))
+		return nil
+	}
+	switch action {
+	case "load", "status":
+	case "play":
+		player.Play()
+	case "pause":
+		player.Pause()
+	case "seek":
+		position, _ := com.Payload["position"].(float64)
+		player.Seek(time.Duration(position * float64(time.Second)))
+	case "speed":
+		speed, _ := com.Payload["speed"].(float64)
+		if err := player.SetSpeed(speed); err != nil {
+			ch.RespondError(com, err)
+			return nil
+		}
+	case "stop":
+		player.Stop()
+		player = nil
+		ch.Respond(com)
+		return nil
+	default:
+		ch.RespondError(com, fmt.Errorf("unknown replay action '%s'", action))
+		return nil
+	}
+	com.Payload["response"] = player.Status()
+	ch.Respond(com)
+	return nil
+}
+
+// stringList converts a json array of strings to a string slice.
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,269 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"viveSyncBroker/persistence"
+)
+
+const (
+	MinSpeed = 0.5
+	MaxSpeed = 10.0
+)
+
+// Filter restricts a replay to records of some sources and/or commands, compared case-insensitively. Empty lists
+// match everything. Only the Commands received from clients are replayed, unless All is set, which adds the records
+// of the broker and sensors.
+type Filter struct {
+	Sources  []string `json:"sources,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	All      bool     `json:"all,omitempty"`
+}
+
+// Event is a recorded Command scheduled at an offset relative to the start of the recording.
+type Event struct {
+	Offset  time.Duration
+	Source  string
+	Command string
+	Data    []byte
+}
+
+// Status describes the playback state of a Player. Position and duration are given in seconds.
+type Status struct {
+	File     string  `json:"file"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	Finished bool    `json:"finished"`
+	Emitted  int     `json:"emitted"`
+	Events   int     `json:"events"`
+}
+
+// Player re-emits the events of a recording with their original relative timing. Every due event is passed to Emit.
+// A Player starts paused.
+type Player struct {
+	Emit         func(Event)
+	file         string
+	events       []Event
+	mu           sync.Mutex
+	index        int
+	speed        float64
+	paused       bool
+	stopped      bool
+	anchorWall   time.Time
+	anchorOffset time.Duration
+	wake         chan struct{}
+}
+
+// Load reads a persistence file and creates a paused Player for the records matching a Filter.
+func Load(file string, filter Filter) (*Player, error) {
+	records, err := persistence.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(records))
+	var start, last time.Time
+	for _, rec := range records {
+		header := struct {
+			Command   string    `json:"command"`
+			Timestamp time.Time `json:"timestamp"`
+		}{}
+		if err := json.Unmarshal(rec.Data, &header); err != nil {
+			continue
+		}
+		if !rec.Time.IsZero() {
+			// Prefer the broker's receive time over the sender's clock
+			header.Timestamp = rec.Time
+		}
+		if rec.Command != "" {
+			header.Command = rec.Command
+		}
+		if header.Timestamp.IsZero() {
+			if last.IsZero() {
+				continue
+			}
+			// Keep the order of records without a timestamp
+			header.Timestamp = last
+		}
+		last = header.Timestamp
+		if start.IsZero() || header.Timestamp.Before(start) {
+			start = header.Timestamp
+		}
+		if !filter.matches(rec, header.Command) {
+			continue
+		}
+		events = append(events, Event{
+			Offset:  time.Duration(header.Timestamp.UnixNano()),
+			Source:  rec.Source,
+			Command: header.Command,
+			Data:    rec.Data,
+		})
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no replayable records in '%s'", file)
+	}
+	for i := range events {
+		events[i].Offset -= time.Duration(start.UnixNano())
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Offset < events[j].Offset
+	})
+	p := &Player{
+		file:   file,
+		events: events,
+		speed:  1,
+		paused: true,
+		wake:   make(chan struct{}, 1),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Play starts or resumes the playback.
+func (p *Player) Play() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	if p.index >= len(p.events) {
+		// Restart a finished playback
+		p.index = 0
+		p.anchorOffset = 0
+	}
+	p.paused = false
+	p.anchorWall = time.Now()
+	p.signal()
+}
+
+// Pause halts the playback at the current position.
+func (p *Player) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return
+	}
+	p.anchorOffset = p.position()
+	p.paused = true
+	p.signal()
+}
+
+// Seek moves the playback to an offset from the start of the recording.
+func (p *Player) Seek(offset time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset < 0 {
+		offset = 0
+	}
+	p.anchorOffset = offset
+	p.anchorWall = time.Now()
+	p.index = sort.Search(len(p.events), func(i int) bool {
+		return p.events[i].Offset >= offset
+	})
+	p.signal()
+}
+
+// SetSpeed changes the playback speed, which must be between MinSpeed and MaxSpeed.
+func (p *Player) SetSpeed(speed float64) error {
+	if speed < MinSpeed || speed > MaxSpeed {
+		return fmt.Errorf("speed must be between %.1f and %.1f", MinSpeed, MaxSpeed)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.anchorOffset = p.position()
+	p.anchorWall = time.Now()
+	p.speed = speed
+	p.signal()
+	return nil
+}
+
+// Stop ends the playback. A stopped Player cannot be resumed.
+func (p *Player) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.signal()
+}
+
+// Status returns the current playback state.
+func (p *Player) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Status{
+		File:     p.file,
+		Position: p.position().Seconds(),
+		Duration: p.events[len(p.events)-1].Offset.Seconds(),
+		Speed:    p.speed,
+		Paused:   p.paused,
+		Finished: p.index >= len(p.events),
+		Emitted:  p.index,
+		Events:   len(p.events),
+	}
+}
+
+// position returns the current playback offset. The caller has to hold the lock.
+func (p *Player) position() time.Duration {
+	if p.paused {
+		return p.anchorOffset
+	}
+	return p.anchorOffset + time.Duration(float64(time.Since(p.anchorWall))*p.speed)
+}
+
+// signal wakes up the playback routine to re-evaluate its schedule. The caller has to hold the lock.
+func (p *Player) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run emits due events until the Player is stopped.
+func (p *Player) run() {
+	for {
+		p.mu.Lock()
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		if p.paused || p.index >= len(p.events) {
+			if !p.paused {
+				p.anchorOffset = p.events[len(p.events)-1].Offset
+				p.paused = true
+			}
+			p.mu.Unlock()
+			<-p.wake
+			continue
+		}
+		ev := p.events[p.index]
+		wait := time.Duration(float64(ev.Offset-p.anchorOffset)/p.speed) - time.Since(p.anchorWall)
+		if wait <= 0 {
+			p.index++
+			p.mu.Unlock()
+			if p.Emit != nil {
+				p.Emit(ev)
+			}
+			continue
+		}
+		p.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-p.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// matches reports if a record with a command passes the Filter. Records of the former format have no direction, their
+// records of clients are inbound.
+func (f Filter) matches(rec persistence.Record, command string) bool {
+	inbound := rec.Direction == persistence.DirectionIn || rec.Direction == ""
+	if !f.All && (!inbound || !persistence.IsClientSource(rec.Source)) {
+		return false
+	}
+	return persistence.Selects(f.Sources, rec.Source) && persistence.Selects(f.Commands, command)
+}
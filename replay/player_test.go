@@ -0,0 +1,40 @@
+package replay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadLegacyCSV(t *testing.T) {
+	for _, test := range []struct {
+		filter   Filter
+		commands []string
+	}{
+		{Filter{}, []string{"set", "msg"}},
+		{Filter{Commands: []string{"msg"}}, []string{"msg"}},
+		{Filter{Sources: []string{"a01b2c"}, All: true}, []string{""}},
+		{Filter{All: true}, []string{"set", "", "msg"}},
+	} {
+		p, err := Load("testdata/legacy.csv", test.filter)
+		if err != nil {
+			t.Fatalf("%+v: %v", test.filter, err)
+		}
+		p.Stop()
+		if len(p.events) != len(test.commands) {
+			t.Fatalf("%+v: got %d events, want %d", test.filter, len(p.events), len(test.commands))
+		}
+		for i, ev := range p.events {
+			if ev.Command != test.commands[i] {
+				t.Errorf("%+v: event %d is %q, want %q", test.filter, i, ev.Command, test.commands[i])
+			}
+		}
+	}
+	p, err := Load("testdata/legacy.csv", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if d := p.events[1].Offset - p.events[0].Offset; d != 2*time.Second {
+		t.Errorf("got offset %s between the commands", d)
+	}
+}
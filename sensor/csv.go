@@ -0,0 +1,204 @@
+package sensor
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// csvColumn is a value column of a CSV recording.
+type csvColumn struct {
+	index   int
+	channel string
+}
+
+// csvRow is a row of a CSV recording at a time in seconds from the start.
+type csvRow struct {
+	offset time.Duration
+	cells  []string
+}
+
+// csvSensor plays back a CSV recording in real time. The samples are timestamped with the time they are played.
+type csvSensor struct {
+	name     string
+	file     string
+	loop     bool
+	speed    float64
+	filter   channelFilter
+	channels []string
+	columns  []csvColumn
+	rows     []csvRow
+	done     chan struct{}
+	once     sync.Once
+	samples  chan Sample
+	status   chan Status
+}
+
+// NewCSV creates a sensor playing back the CSV file SENSOR_<NAME>_FILE. The first column is the time in seconds from
+// the start of the recording, the others are channels named by the header. Columns named "<channel>:<axis>", e.g.
+// "acc:x", "acc:y" and "acc:z", are the values of one sample; empty cells are left out. With SENSOR_<NAME>_LOOP=true
+// the file is repeated, SENSOR_<NAME>_SPEED changes the playback speed, e.g. "2" for twice as fast.
+func NewCSV(name string, env func(key string) string) ([]Adapter, error) {
+	s := &csvSensor{
+		name:    name,
+		file:    env("FILE"),
+		loop:    env("LOOP") == "true",
+		speed:   1,
+		done:    make(chan struct{}),
+		samples: make(chan Sample, 256),
+		status:  make(chan Status, 16),
+	}
+	if s.file == "" {
+		return nil, fmt.Errorf("missing %s", Env(name, "FILE"))
+	}
+	if speed := env("SPEED"); speed != "" {
+		v, err := strconv.ParseFloat(speed, 64)
+		if err != nil || v <= 0 {
+			fmt.Printf("invalid %s '%s'\n", Env(name, "SPEED"), speed)
+		} else {
+			s.speed = v
+		}
+	}
+	return []Adapter{s}, nil
+}
+
+func (s *csvSensor) Kind() string                  { return "csv" }
+func (s *csvSensor) Name() string                  { return s.name }
+func (s *csvSensor) Channels() []string            { return s.channels }
+func (s *csvSensor) Samples() <-chan Sample        { return s.samples }
+func (s *csvSensor) Status() <-chan Status         { return s.status }
+func (s *csvSensor) Start(channels []string) error { s.filter.start(channels); return nil }
+func (s *csvSensor) Stop(channels []string) error  { s.filter.stop(channels); return nil }
+
+// Connect reads the file and starts the playback.
+func (s *csvSensor) Connect() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	go s.play()
+	return nil
+}
+
+// Close stops the playback.
+func (s *csvSensor) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// load reads the header and the rows of the file.
+func (s *csvSensor) load() error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.file, err)
+	}
+	if len(records) == 0 || len(records[0]) < 2 {
+		return fmt.Errorf("%s: missing header with time and channel columns", s.file)
+	}
+	s.channels, s.columns, s.rows = nil, nil, nil
+	for i, header := range records[0][1:] {
+		channel := strings.TrimSpace(header)
+		if j := strings.Index(channel, ":"); j >= 0 {
+			channel = channel[:j]
+		}
+		if len(s.channels) == 0 || s.channels[len(s.channels)-1] != channel {
+			s.channels = append(s.channels, channel)
+		}
+		s.columns = append(s.columns, csvColumn{index: i + 1, channel: channel})
+	}
+	for line, record := range records[1:] {
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid time '%s'", s.file, line+2, record[0])
+		}
+		s.rows = append(s.rows, csvRow{offset: time.Duration(seconds * float64(time.Second)), cells: record})
+	}
+	if len(s.rows) == 0 {
+		return fmt.Errorf("%s: no rows", s.file)
+	}
+	return nil
+}
+
+// play passes the samples of the rows at their time, and repeats the file if it loops.
+func (s *csvSensor) play() {
+	defer close(s.status)
+	defer close(s.samples)
+	s.emit(Status{Status: StatusConnected})
+	start := time.Now()
+	for {
+		for _, row := range s.rows {
+			at := start.Add(time.Duration(float64(row.offset-s.rows[0].offset) / s.speed))
+			select {
+			case <-s.done:
+				return
+			case <-time.After(time.Until(at)):
+			}
+			s.playRow(row, at)
+		}
+		if !s.loop {
+			s.emit(Status{Status: StatusFinished})
+			return
+		}
+		// The first row of the next run follows the last one by the mean interval of the rows
+		last := s.rows[len(s.rows)-1].offset - s.rows[0].offset
+		step := time.Second
+		if len(s.rows) > 1 {
+			step = last / time.Duration(len(s.rows)-1)
+		}
+		start = start.Add(time.Duration(float64(last+step) / s.speed))
+	}
+}
+
+// playRow passes the samples of a row.
+func (s *csvSensor) playRow(row csvRow, at time.Time) {
+	var sample *Sample
+	for _, column := range s.columns {
+		if sample != nil && sample.Channel != column.channel {
+			s.send(*sample)
+			sample = nil
+		}
+		if column.index >= len(row.cells) || strings.TrimSpace(row.cells[column.index]) == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(row.cells[column.index]), 64)
+		if err != nil {
+			fmt.Printf("Error: sensor %s: invalid value '%s' of channel %s\n", s.name, row.cells[column.index],
+				column.channel)
+			continue
+		}
+		if sample == nil {
+			sample = &Sample{Sensor: s.name, Channel: column.channel, Timestamp: at, Received: time.Now()}
+		}
+		sample.Values = append(sample.Values, v)
+	}
+	if sample != nil {
+		s.send(*sample)
+	}
+}
+
+// send passes a sample of a started channel.
+func (s *csvSensor) send(sample Sample) {
+	if s.filter.started(sample.Channel) {
+		s.samples <- sample
+	}
+}
+
+// emit passes a status change.
+func (s *csvSensor) emit(st Status) {
+	st.Sensor = s.name
+	st.Time = time.Now()
+	s.status <- st
+}
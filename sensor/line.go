@@ -0,0 +1,212 @@
+package sensor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delays between the connection attempts of line sensors.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// ParseLine parses a line of the line protocol: the channel followed by its values, separated by spaces, tabs,
+// commas or semicolons, e.g. "hr 72" or "acc,0.1,-0.2,0.98". A channel without values is an event, e.g. a button
+// press.
+func ParseLine(line string) (string, []float64, error) {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == ';' || r == '\r'
+	})
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("empty line")
+	}
+	values := make([]float64, 0, len(fields)-1)
+	for _, field := range fields[1:] {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value '%s' of channel %s", field, fields[0])
+		}
+		values = append(values, v)
+	}
+	return fields[0], values, nil
+}
+
+// lineSensor reads the line protocol from a connection, which is reopened when it ends. Lines starting with "#" are
+// comments. The samples are timestamped with the time they are received.
+type lineSensor struct {
+	kind     string
+	name     string
+	open     func() (io.ReadCloser, error)
+	filter   channelFilter
+	mu       sync.Mutex
+	channels map[string]bool
+	conn     io.ReadCloser
+	done     chan struct{}
+	once     sync.Once
+	samples  chan Sample
+	status   chan Status
+}
+
+// NewSerial creates a sensor reading the line protocol from the serial port SENSOR_<NAME>_PORT, e.g. "/dev/ttyUSB0".
+// The port is read like a file, so its baud rate is set with the tools of the system, e.g. "stty -F /dev/ttyUSB0
+// 115200 raw".
+func NewSerial(name string, env func(key string) string) ([]Adapter, error) {
+	port := env("PORT")
+	if port == "" {
+		return nil, fmt.Errorf("missing %s", Env(name, "PORT"))
+	}
+	return []Adapter{newLineSensor("serial", name, func() (io.ReadCloser, error) {
+		return os.Open(port)
+	})}, nil
+}
+
+// NewTCP creates a sensor reading the line protocol from a TCP connection to SENSOR_<NAME>_ADDRESS, e.g.
+// "192.168.1.20:5000".
+func NewTCP(name string, env func(key string) string) ([]Adapter, error) {
+	address := env("ADDRESS")
+	if address == "" {
+		return nil, fmt.Errorf("missing %s", Env(name, "ADDRESS"))
+	}
+	return []Adapter{newLineSensor("tcp", name, func() (io.ReadCloser, error) {
+		return net.DialTimeout("tcp", address, 5*time.Second)
+	})}, nil
+}
+
+// newLineSensor creates a line sensor reading from the connections returned by open.
+func newLineSensor(kind string, name string, open func() (io.ReadCloser, error)) *lineSensor {
+	return &lineSensor{
+		kind:     kind,
+		name:     name,
+		open:     open,
+		channels: make(map[string]bool),
+		done:     make(chan struct{}),
+		samples:  make(chan Sample, 256),
+		status:   make(chan Status, 16),
+	}
+}
+
+func (s *lineSensor) Kind() string                  { return s.kind }
+func (s *lineSensor) Name() string                  { return s.name }
+func (s *lineSensor) Samples() <-chan Sample        { return s.samples }
+func (s *lineSensor) Status() <-chan Status         { return s.status }
+func (s *lineSensor) Start(channels []string) error { s.filter.start(channels); return nil }
+func (s *lineSensor) Stop(channels []string) error  { s.filter.stop(channels); return nil }
+
+// Channels returns the channels received so far.
+func (s *lineSensor) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels := make([]string, 0, len(s.channels))
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Connect starts reading. Connection failures are reported as status and retried with exponential backoff.
+func (s *lineSensor) Connect() error {
+	go s.run()
+	return nil
+}
+
+// Close ends the connection and stops reconnecting.
+func (s *lineSensor) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// run opens the connection and reads it until the sensor is closed.
+func (s *lineSensor) run() {
+	defer close(s.status)
+	defer close(s.samples)
+	backoff := minBackoff
+	attempt := 0
+	for {
+		err := s.read()
+		if err == nil {
+			backoff = minBackoff
+			attempt = 0
+			err = fmt.Errorf("connection ended")
+		}
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		attempt++
+		s.emit(Status{Status: StatusReconnecting, Detail: err.Error(), Attempt: attempt})
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// read opens a connection and passes its samples until it ends. It returns an error if it could not be opened.
+func (s *lineSensor) read() error {
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return conn.Close()
+	default:
+	}
+	s.emit(Status{Status: StatusConnected})
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		received := time.Now()
+		channel, values, err := ParseLine(line)
+		if err != nil {
+			fmt.Printf("Error: sensor %s: %+v\n", s.name, err)
+			continue
+		}
+		s.mu.Lock()
+		s.channels[channel] = true
+		s.mu.Unlock()
+		if s.filter.started(channel) {
+			s.samples <- Sample{Sensor: s.name, Channel: channel, Timestamp: received, Values: values, Received: received}
+		}
+	}
+	s.mu.Lock()
+	s.conn = nil
+	s.mu.Unlock()
+	_ = conn.Close()
+	return nil
+}
+
+// emit passes a status change.
+func (s *lineSensor) emit(st Status) {
+	st.Sensor = s.name
+	st.Time = time.Now()
+	s.status <- st
+}
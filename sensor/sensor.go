@@ -0,0 +1,190 @@
+// Package sensor is the common interface of the sensors the broker records, e.g. the Empatica E4 wristbands, devices
+// writing a line protocol to a serial port or a TCP connection, and recordings played back from CSV files. Adapters
+// are created by the factory registered for their kind, so the broker persists and publishes the samples of every
+// sensor the same way.
+package sensor
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sensor states reported by the adapters.
+const (
+	StatusConnected    = "connected"
+	StatusReconnecting = "reconnecting"
+	StatusDeviceLost   = "device_lost"
+	StatusBatteryLow   = "battery_low"
+	StatusFinished     = "finished"
+)
+
+// Sample is a sample of a channel of a sensor. The json names are those of the E4 records, which the inspect package
+// reads.
+type Sample struct {
+	Sensor    string    `json:"device,omitempty"`
+	Channel   string    `json:"stream"`
+	Timestamp time.Time `json:"timestamp"`
+	Values    []float64 `json:"values"`
+	// Aligned is the timestamp on the broker's clock, if the sensor has a clock of its own.
+	Aligned     time.Time `json:"aligned,omitempty"`
+	Uncertainty float64   `json:"uncertainty,omitempty"`
+	Received    time.Time `json:"-"`
+}
+
+// Time returns the aligned timestamp, or the timestamp if the sample is not aligned.
+func (s Sample) Time() time.Time {
+	if s.Aligned.IsZero() {
+		return s.Timestamp
+	}
+	return s.Aligned
+}
+
+// Status is a change in the connection state of a sensor, or a warning.
+type Status struct {
+	Sensor  string    `json:"device"`
+	Status  string    `json:"status"`
+	Time    time.Time `json:"time"`
+	Detail  string    `json:"detail,omitempty"`
+	Attempt int       `json:"attempt,omitempty"`
+	Battery float64   `json:"battery,omitempty"`
+}
+
+// Adapter is a sensor. Its samples are persisted as "<kind>_<channel>" records of the source "<kind>:<name>".
+type Adapter interface {
+	// Kind is the kind the adapter is registered as, e.g. "e4".
+	Kind() string
+	// Name identifies the sensor among those of its kind, e.g. the device ID.
+	Name() string
+	// Connect connects the sensor and keeps it connected until Close.
+	Connect() error
+	// Channels lists the channels the sensor provides.
+	Channels() []string
+	// Start starts sampling the given channels, or all channels if none are given. Initially, the configured
+	// channels are started; before Connect, Start and Stop select the channels sampled once connected.
+	Start(channels []string) error
+	// Stop stops sampling the given channels, or all channels if none are given.
+	Stop(channels []string) error
+	// Samples passes the samples of the started channels. It is closed when the sensor is closed.
+	Samples() <-chan Sample
+	// Status passes the status changes. It is closed when the sensor is closed.
+	Status() <-chan Status
+	// Close disconnects the sensor.
+	Close() error
+}
+
+// Factory creates the adapters of a sensor configured under a name. A factory may create several adapters, e.g. one
+// per wristband. env returns the configuration of the sensor, see Env.
+type Factory func(name string, env func(key string) string) ([]Adapter, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = map[string]Factory{
+		"serial": NewSerial,
+		"tcp":    NewTCP,
+		"csv":    NewCSV,
+	}
+)
+
+// Register registers the factory of a kind of sensor.
+func Register(kind string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[kind] = factory
+}
+
+// Kinds returns the registered kinds, ordered by name.
+func Kinds() []string {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	kinds := make([]string, 0, len(factories))
+	for kind := range factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Open creates the adapters of a sensor given as "<name>:<kind>", e.g. "strap:serial", or as "<kind>" if the name is
+// the kind.
+func Open(spec string) ([]Adapter, error) {
+	name, kind := spec, spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, kind = spec[:i], spec[i+1:]
+	}
+	factoriesMu.Lock()
+	factory, found := factories[kind]
+	factoriesMu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unknown sensor kind '%s' of sensor '%s'", kind, name)
+	}
+	return factory(name, func(key string) string {
+		return os.Getenv(Env(name, key))
+	})
+}
+
+// Env returns the environment variable of a setting of a sensor, e.g. "SENSOR_STRAP_PORT" for the key "PORT" of the
+// sensor "strap".
+func Env(name string, key string) string {
+	return "SENSOR_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name) + "_" + key
+}
+
+// channelFilter holds the started channels of a sensor. Initially, all channels are started.
+type channelFilter struct {
+	mu      sync.Mutex
+	stopped bool
+	on      map[string]bool
+	off     map[string]bool
+}
+
+// start starts the given channels, or all channels.
+func (f *channelFilter) start(channels []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.on == nil {
+		f.on, f.off = make(map[string]bool), make(map[string]bool)
+	}
+	if len(channels) == 0 {
+		f.stopped = false
+		f.off = make(map[string]bool)
+	}
+	for _, channel := range channels {
+		f.on[channel] = true
+		delete(f.off, channel)
+	}
+}
+
+// stop stops the given channels, or all channels.
+func (f *channelFilter) stop(channels []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.on == nil {
+		f.on, f.off = make(map[string]bool), make(map[string]bool)
+	}
+	if len(channels) == 0 {
+		f.stopped = true
+		f.on = make(map[string]bool)
+	}
+	for _, channel := range channels {
+		f.off[channel] = true
+		delete(f.on, channel)
+	}
+}
+
+// started reports whether a channel is sampled.
+func (f *channelFilter) started(channel string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.on[channel] || !f.stopped && !f.off[channel]
+}
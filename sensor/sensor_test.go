@@ -0,0 +1,119 @@
+package sensor
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	for line, want := range map[string][]float64{
+		"hr 72":               {72},
+		"acc,0.1,-0.2;0.98\r": {0.1, -0.2, 0.98},
+		"button":              {},
+	} {
+		channel, values, err := ParseLine(line)
+		if err != nil || channel == "" || !reflect.DeepEqual(values, want) {
+			t.Errorf("%q: got %s %v %v", line, channel, values, err)
+		}
+	}
+	if _, _, err := ParseLine("hr seventy"); err == nil {
+		t.Error("parsed invalid value")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("# comment\nhr 72\ngsr 2.5\ninvalid x\nhr 73\n"))
+		_ = conn.Close()
+	}()
+	adapters, err := Open("strap:tcp")
+	if err == nil {
+		t.Fatal("opened tcp sensor without address")
+	}
+	t.Setenv("SENSOR_STRAP_ADDRESS", listener.Addr().String())
+	if adapters, err = Open("strap:tcp"); err != nil || len(adapters) != 1 {
+		t.Fatalf("got %v, %v", adapters, err)
+	}
+	s := adapters[0]
+	_ = s.Stop([]string{"gsr"})
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if st := <-s.Status(); st.Status != StatusConnected || st.Sensor != "strap" {
+		t.Errorf("got status %+v", st)
+	}
+	for _, want := range []float64{72, 73} {
+		select {
+		case sample := <-s.Samples():
+			if sample.Channel != "hr" || sample.Values[0] != want || sample.Received.IsZero() {
+				t.Errorf("got sample %+v", sample)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no sample")
+		}
+	}
+	if st := <-s.Status(); st.Status != StatusReconnecting {
+		t.Errorf("got status %+v", st)
+	}
+	if channels := s.Channels(); !reflect.DeepEqual(channels, []string{"gsr", "hr"}) {
+		t.Errorf("got channels %v", channels)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "baseline.csv")
+	data := "time,gsr,acc:x,acc:y\n0,2.1,0.1,0.2\n0.05,,0.3,0.4\n0.1,2.2,,\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	adapters, err := NewCSV("baseline", func(key string) string {
+		return map[string]string{"FILE": file, "SPEED": "10"}[key]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := adapters[0]
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if channels := s.Channels(); !reflect.DeepEqual(channels, []string{"gsr", "acc"}) {
+		t.Errorf("got channels %v", channels)
+	}
+	var got []Sample
+	for sample := range s.Samples() {
+		got = append(got, sample)
+	}
+	want := [][]float64{{2.1}, {0.1, 0.2}, {0.3, 0.4}, {2.2}}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for i, sample := range got {
+		if !reflect.DeepEqual(sample.Values, want[i]) {
+			t.Errorf("sample %d: got %+v", i, sample)
+		}
+	}
+	if d := got[3].Timestamp.Sub(got[0].Timestamp); d != 10*time.Millisecond {
+		t.Errorf("got playback time %s", d)
+	}
+	var last Status
+	for st := range s.Status() {
+		last = st
+	}
+	if last.Status != StatusFinished {
+		t.Errorf("got status %+v", last)
+	}
+}
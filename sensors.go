@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"viveSyncBroker/empatica"
+	"viveSyncBroker/empatica/metrics"
+	"viveSyncBroker/persistence"
+	"viveSyncBroker/sensor"
+)
+
+// sensors are the connected sensors.
+var sensors []sensor.Adapter
+
+// SensorInfo describes a sensor for "get sensors".
+type SensorInfo struct {
+	Kind     string   `json:"kind"`
+	Name     string   `json:"name"`
+	Channels []string `json:"channels"`
+}
+
+// setupSensors connects the sensors listed in SENSORS as "<name>:<kind>" or "<kind>", e.g.
+// "e4,strap:serial,eyes:tcp,baseline:csv"; with E4_ACTIVE=true, "e4" is added. Every sensor is configured by
+// SENSOR_<NAME>_* variables, e.g. SENSOR_STRAP_PORT; SENSOR_<NAME>_CHANNELS restricts the sampled channels. The
+// samples of every sensor are persisted as "<kind>_<channel>" records of the source "<kind>:<name>", published with
+// the SENSOR_<NAME>_FORWARD_* settings, and channels named "tag" are broadcast as markers. The E4 devices keep their
+// E4_* settings.
+func setupSensors(ch *CommandHandler) error {
+	specs := splitList(os.Getenv("SENSORS"))
+	if os.Getenv("E4_ACTIVE") == "true" {
+		found := false
+		for _, spec := range specs {
+			found = found || spec == "e4" || strings.HasSuffix(spec, ":e4")
+		}
+		if !found {
+			specs = append(specs, "e4")
+		}
+	}
+	sensor.Register("e4", empatica.NewAdapters)
+	e4Forwarder := newSampleForwarder(ch.nm.Pubsub, "e4", "E4_")
+	processor := setupE4Metrics(ch)
+	for _, spec := range specs {
+		adapters, err := sensor.Open(spec)
+		if err != nil {
+			return err
+		}
+		for _, a := range adapters {
+			name := spec
+			if i := strings.Index(spec, ":"); i >= 0 {
+				name = spec[:i]
+			}
+			if channels := splitList(os.Getenv(sensor.Env(name, "CHANNELS"))); len(channels) > 0 {
+				_ = a.Stop(nil)
+				if err := a.Start(channels); err != nil {
+					return fmt.Errorf("sensor %s: %w", name, err)
+				}
+			}
+			forwarder, derive := e4Forwarder, processor
+			if a.Kind() != "e4" {
+				forwarder = newSampleForwarder(ch.nm.Pubsub, a.Kind(), sensor.Env(name, ""))
+				derive = nil
+			}
+			go recordSamples(ch, a, forwarder, derive)
+			go recordStatus(ch, a)
+			if err := a.Connect(); err != nil {
+				return fmt.Errorf("sensor %s: %w", name, err)
+			}
+			sensors = append(sensors, a)
+		}
+	}
+	return nil
+}
+
+// Sensors returns the connected sensors.
+func Sensors() []SensorInfo {
+	result := make([]SensorInfo, 0, len(sensors))
+	for _, a := range sensors {
+		result = append(result, SensorInfo{Kind: a.Kind(), Name: a.Name(), Channels: a.Channels()})
+	}
+	return result
+}
+
+// recordSamples persists the samples of a sensor at the time they were received, forwards them to clients, passes
+// them to the metrics and broadcasts tags as markers. Samples of sensors without a clock of their own are timestamped
+// by the broker, so their timestamp is the aligned one.
+func recordSamples(ch *CommandHandler, a sensor.Adapter, forwarder *sampleForwarder, processor *metrics.Processor) {
+	for s := range a.Samples() {
+		if s.Received.IsZero() {
+			s.Received = time.Now()
+		}
+		if s.Aligned.IsZero() {
+			s.Aligned = s.Timestamp
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			fmt.Printf("Error: %+v\n", err)
+		}
+		ch.nm.Persist.AddRecord(persistence.Record{
+			Time:      s.Received,
+			Source:    a.Kind() + ":" + a.Name(),
+			Command:   a.Kind() + "_" + s.Channel,
+			Topic:     a.Kind(),
+			Direction: persistence.DirectionIn,
+			Data:      data,
+		})
+		if forwarder != nil {
+			forwarder.Forward(s)
+		}
+		if processor != nil {
+			processor.Add(s)
+		}
+		if s.Channel == "tag" {
+			tagMarker(ch, a, s)
+		}
+	}
+}
+
+// recordStatus persists the status changes of a sensor as "<kind>_status" record and broadcasts them.
+func recordStatus(ch *CommandHandler, a sensor.Adapter) {
+	for st := range a.Status() {
+		com := sensorStatusCommand(a.Kind(), st)
+		data, err := json.Marshal(map[string]interface{}{
+			"command":   *com.Command,
+			"timestamp": st.Time,
+			"payload":   st,
+		})
+		if err != nil {
+			fmt.Printf("Error: %+v\n", err)
+		}
+		ch.nm.Persist.AddRecord(persistence.Record{
+			Time:      st.Time,
+			Source:    a.Kind() + ":" + a.Name(),
+			Command:   *com.Command,
+			Topic:     a.Kind(),
+			Direction: persistence.DirectionIn,
+			Data:      data,
+		})
+		ch.Broadcast(com)
+	}
+}
+
+// sensorStatusCommand creates the "<kind>_status" Command, e.g. "e4_status", broadcast on status changes.
+func sensorStatusCommand(kind string, st sensor.Status) *Command {
+	payload := map[string]interface{}{
+		"device": st.Sensor,
+		"status": st.Status,
+	}
+	if st.Detail != "" {
+		payload["detail"] = st.Detail
+	}
+	if st.Attempt > 0 {
+		payload["attempt"] = st.Attempt
+	}
+	if st.Status == sensor.StatusBatteryLow {
+		payload["battery"] = st.Battery
+	}
+	com := NewCommand(kind+"_status", payload)
+	com.Timestamp = &st.Time
+	return com
+}
+
+// sampleForwarder publishes samples as Commands named after their kind and channel, e.g. "e4_gsr", on a topic per
+// channel. With an interval, the samples of each sensor and channel are downsampled to one Command per interval
+// holding the mean of the values.
+type sampleForwarder struct {
+	ps       *Pubsub
+	kind     string
+	streams  map[string]bool
+	topic    string
+	interval time.Duration
+	mu       sync.Mutex
+	windows  map[string]*sampleWindow
+}
+
+// sampleWindow collects the samples of a sensor and channel within a downsampling interval.
+type sampleWindow struct {
+	device  string
+	stream  string
+	last    time.Time
+	sums    []float64
+	samples int
+}
+
+// newSampleForwarder reads the forwarding configuration of a kind of sensor from the variables with a prefix, e.g.
+// "E4_". It returns nil if no channel is forwarded.
+//
+//	<prefix>FORWARD_STREAMS:  comma separated channels to publish, e.g. "gsr,ibi", or "all"
+//	<prefix>FORWARD_TOPIC:    topic pattern with the placeholders {stream} and {device}, default "<kind>/{stream}"
+//	<prefix>FORWARD_INTERVAL: downsampling interval, e.g. "250ms", default 0 for every sample
+func newSampleForwarder(ps *Pubsub, kind string, prefix string) *sampleForwarder {
+	streams := splitList(os.Getenv(prefix + "FORWARD_STREAMS"))
+	if len(streams) == 0 {
+		return nil
+	}
+	f := &sampleForwarder{
+		ps:      ps,
+		kind:    kind,
+		streams: make(map[string]bool),
+		topic:   os.Getenv(prefix + "FORWARD_TOPIC"),
+		windows: make(map[string]*sampleWindow),
+	}
+	for _, stream := range streams {
+		f.streams[strings.ToLower(stream)] = true
+	}
+	if f.topic == "" {
+		f.topic = kind + "/{stream}"
+	}
+	if s := os.Getenv(prefix + "FORWARD_INTERVAL"); s != "" {
+		interval, err := time.ParseDuration(s)
+		if err != nil {
+			fmt.Printf("invalid %sFORWARD_INTERVAL '%s', forwarding every sample\n", prefix, s)
+		}
+		f.interval = interval
+	}
+	if f.interval > 0 {
+		go func() {
+			for range time.Tick(f.interval) {
+				f.flush()
+			}
+		}()
+	}
+	return f
+}
+
+// Forward publishes a sample, or adds it to the current interval of its sensor and channel, which is published by
+// flush. Events without values, like tags, are never downsampled.
+func (f *sampleForwarder) Forward(s sensor.Sample) {
+	device := s.Sensor
+	stream := s.Channel
+	if !f.streams[stream] && !f.streams["all"] {
+		return
+	}
+	t := s.Time()
+	if f.interval <= 0 || len(s.Values) == 0 {
+		f.publish(device, stream, t, s.Values, 1)
+		return
+	}
+	key := device + "/" + stream
+	f.mu.Lock()
+	var done *sampleWindow
+	w := f.windows[key]
+	if w != nil && len(w.sums) != len(s.Values) {
+		done, w = w, nil
+	}
+	if w == nil {
+		w = &sampleWindow{device: device, stream: stream, sums: make([]float64, len(s.Values))}
+		f.windows[key] = w
+	}
+	for i, v := range s.Values {
+		w.sums[i] += v
+	}
+	w.last = t
+	w.samples++
+	f.mu.Unlock()
+	if done != nil {
+		f.publishWindow(done)
+	}
+}
+
+// flush publishes the intervals of all sensors and channels that got samples and starts new ones.
+func (f *sampleForwarder) flush() {
+	f.mu.Lock()
+	windows := f.windows
+	f.windows = make(map[string]*sampleWindow)
+	f.mu.Unlock()
+	for _, w := range windows {
+		f.publishWindow(w)
+	}
+}
+
+// publishWindow publishes the mean values of an interval, stamped with the time of its last sample.
+func (f *sampleForwarder) publishWindow(w *sampleWindow) {
+	values := make([]float64, len(w.sums))
+	for i, sum := range w.sums {
+		values[i] = sum / float64(w.samples)
+	}
+	f.publish(w.device, w.stream, w.last, values, w.samples)
+}
+
+// publish sends the values of a channel as Command to the channel's topic, stamped with the aligned time.
+func (f *sampleForwarder) publish(device string, stream string, t time.Time, values []float64, samples int) {
+	com := NewCommand(f.kind+"_"+stream, map[string]interface{}{
+		"device":  device,
+		"stream":  stream,
+		"values":  values,
+		"samples": samples,
+	})
+	com.Timestamp = &t
+	topic := strings.NewReplacer("{stream}", stream, "{device}", device).Replace(f.topic)
+	f.ps.Publish(topic, com.ToBytes())
+}
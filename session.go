@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"viveSyncBroker/persistence"
+	"viveSyncBroker/sensor"
+)
+
+var (
+	SessionRequired = false
+)
+
+// setupSessions reads the session configuration. If SESSION_REQUIRED is set, session-scoped commands are rejected
+// outside a running session.
+func setupSessions() {
+	required, err := strconv.ParseBool(os.Getenv("SESSION_REQUIRED"))
+	if err != nil {
+		required = false
+	}
+	SessionRequired = required
+}
+
+// sessionConfigKeys are the configuration variables recorded in the session manifest, the ones that affect what is
+// recorded and how. Addresses, key files and passphrases are left out.
+var sessionConfigKeys = []string{
+	"PLAIN_MODE", "SESSION_REQUIRED", "STUDY_PROTOCOL_FILE", "REPLAY_FILE", "MARKER_TOPICS",
+	"COUNTERBALANCE_CONDITIONS", "COUNTERBALANCE_TABLE",
+	"PERSIST_EVENTS", "PERSIST_BACKENDS", "PERSIST_PATTERN", "PERSIST_COMPRESS", "PERSIST_ROTATE_SIZE",
+	"PERSIST_ROTATE_INTERVAL", "PERSIST_QUEUE_SIZE", "PERSIST_QUEUE_POLICY", "PERSIST_FSYNC_INTERVAL",
+	"PERSIST_REDACT_ADDRESSES", "PERSIST_REDACT_DROP", "PERSIST_REDACT_MASK", "PERSIST_PSEUDONYM_KEYS",
+	"SENSORS", "E4_ACTIVE", "E4_DEVICES", "E4_STREAMS", "E4_REQUEST_TIMEOUT", "E4_RECONNECT_MIN", "E4_RECONNECT_MAX",
+	"E4_RECONNECT_GRACE", "E4_BATTERY_LOW", "E4_CLOCK_WINDOW", "E4_FORWARD_STREAMS", "E4_FORWARD_TOPIC",
+	"E4_FORWARD_INTERVAL", "E4_METRICS_INTERVAL", "E4_METRICS_WINDOW", "E4_METRICS_TONIC", "E4_METRICS_TOPIC",
+	"E4_SCR_THRESHOLD",
+}
+
+// sensorConfigKeys are the SENSOR_<NAME>_* variables recorded in the session manifest for every sensor in SENSORS.
+var sensorConfigKeys = []string{"CHANNELS", "SPEED", "LOOP", "FORWARD_STREAMS", "FORWARD_TOPIC", "FORWARD_INTERVAL"}
+
+// sessionConfig collects the broker configuration for the session manifest from the variables that are set.
+func sessionConfig() map[string]string {
+	keys := append([]string{}, sessionConfigKeys...)
+	for _, spec := range splitList(os.Getenv("SENSORS")) {
+		name := strings.SplitN(spec, ":", 2)[0]
+		for _, key := range sensorConfigKeys {
+			keys = append(keys, sensor.Env(name, key))
+		}
+	}
+	config := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := os.LookupEnv(key); ok {
+			config[key] = value
+		}
+	}
+	return config
+}
+
+// SessionStartCommand is the Command for "session_start". The payload carries the "participant" and optional
+// "metadata". The participant is assigned a condition sequence before the session starts, and the study protocol is
+// (re)started.
+func SessionStartCommand(com *Command, ch *CommandHandler) error {
+	participant, _ := com.Payload["participant"].(string)
+	participant = strings.TrimSpace(participant)
+	metadata, _ := com.Payload["metadata"].(map[string]interface{})
+	session := &persistence.Session{
+		Participant:   participant,
+		Metadata:      metadata,
+		Config:        sessionConfig(),
+		BrokerVersion: Version,
+	}
+	if running := ch.nm.Persist.Session(); running != nil {
+		// The assignment of the running session is kept
+		ch.RespondError(com, fmt.Errorf("session '%s' is still running", running.ID))
+		return nil
+	}
+	if conditions != nil {
+		assignment, err := assignParticipant(participant)
+		if err != nil {
+			ch.RespondError(com, err)
+			return nil
+		}
+		com.Payload["assignment"] = assignment
+	}
+	if err := ch.nm.Persist.StartSession(session); err != nil {
+		ch.RespondError(com, err)
+		return nil
+	}
+	com.Payload["session"] = session
+	ch.Persist(com, PubSubTopicBasic)
+	ch.Broadcast(com)
+	if studyRunner != nil {
+		studyRunner.Start()
+	}
+	return nil
+}
+
+// SessionEndCommand is the Command for "session_end". It stops the study protocol and completes the session
+// manifest.
+func SessionEndCommand(com *Command, ch *CommandHandler) error {
+	if studyRunner != nil {
+		studyRunner.Stop()
+	}
+	ch.Persist(com, PubSubTopicBasic)
+	session, err := ch.nm.Persist.EndSession(ch.nm.Pubsub.GetClients())
+	if session == nil {
+		ch.RespondError(com, err)
+		return nil
+	}
+	if err != nil {
+		ch.RespondError(com, err)
+	}
+	com.Payload["session"] = session
+	ch.Broadcast(com)
+	return nil
+}
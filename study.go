@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"viveSyncBroker/study"
+)
+
+var (
+	studyRunner *study.Runner
+)
+
+// setupStudy loads the study protocol configured through STUDY_PROTOCOL_FILE and starts it. Phase changes are
+// broadcast and persisted as "phase" Commands; every other handled Command may trigger a transition.
+func setupStudy(ch *CommandHandler) error {
+	file := os.Getenv("STUDY_PROTOCOL_FILE")
+	if file == "" {
+		return nil
+	}
+	protocol, err := study.Load(file)
+	if err != nil {
+		return err
+	}
+	studyRunner = study.NewRunner(protocol)
+	studyRunner.OnTransition = func(from study.State, to study.State, cause string) {
+		com := NewCommand("phase", map[string]interface{}{
+			"protocol": protocol.Name,
+			"from":     from,
+			"to":       to,
+			"cause":    cause,
+		})
+		ch.Persist(com, PubSubTopicBasic)
+		ch.Broadcast(com)
+	}
+	ch.Observe(func(com *Command) {
+		if *com.Command == "phase" {
+			// The jump was already executed by the runner and must not trigger the transitions of the new phase
+			return
+		}
+		studyRunner.Trigger(*com.Command, com.Payload)
+	})
+	if !SessionRequired {
+		// Otherwise the protocol starts with the session
+		studyRunner.Start()
+	}
+	return nil
+}
+
+// PhaseCommand is the Command for "phase". It jumps to the phase given as "target" in the payload, which may also be
+// "next" or "end". Once the protocol is finished, it is only restarted by a new session.
+func PhaseCommand(com *Command, ch *CommandHandler) error {
+	if studyRunner == nil {
+		ch.RespondError(com, fmt.Errorf("no study protocol loaded"))
+		return nil
+	}
+	target, _ := com.Payload["target"].(string)
+	if err := studyRunner.Goto(target, "phase"); err != nil {
+		ch.RespondError(com, err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package study
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// TargetNext advances to the next trial of the current phase or, after the last trial, to the following phase.
+	TargetNext = "next"
+	// TargetEnd finishes the protocol.
+	TargetEnd = "end"
+)
+
+// Duration wraps time.Duration to be read from strings like "90s" or "2m30s" in protocol files.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration as string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Transition describes a phase change. It is either triggered by a received command (optionally matching payload
+// values) or by a timeout after entering the phase.
+type Transition struct {
+	Command string                 `json:"command,omitempty"`
+	Match   map[string]interface{} `json:"match,omitempty"`
+	Timeout Duration               `json:"timeout,omitempty"`
+	Target  string                 `json:"target"`
+}
+
+// Phase is a named step of a study. A phase may be repeated for several trials, each trial running one of the
+// phase's conditions.
+type Phase struct {
+	Name        string       `json:"name"`
+	Trials      int          `json:"trials,omitempty"`
+	Conditions  []string     `json:"conditions,omitempty"`
+	Transitions []Transition `json:"transitions"`
+}
+
+// Protocol is the definition of a study: an ordered list of phases.
+type Protocol struct {
+	Name   string  `json:"name"`
+	Phases []Phase `json:"phases"`
+}
+
+// Load reads a protocol definition from a json file and validates it.
+func Load(path string) (*Protocol, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Protocol{}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("could not parse protocol '%s': %v", path, err)
+	}
+	if err = p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid protocol '%s': %v", path, err)
+	}
+	return p, nil
+}
+
+// Validate checks that phase names are unique and every transition has a valid target and trigger.
+func (p *Protocol) Validate() error {
+	if len(p.Phases) == 0 {
+		return fmt.Errorf("no phases defined")
+	}
+	names := make(map[string]bool, len(p.Phases))
+	for _, phase := range p.Phases {
+		if phase.Name == "" || phase.Name == TargetNext || phase.Name == TargetEnd {
+			return fmt.Errorf("invalid phase name '%s'", phase.Name)
+		}
+		if names[phase.Name] {
+			return fmt.Errorf("duplicate phase '%s'", phase.Name)
+		}
+		names[phase.Name] = true
+	}
+	for _, phase := range p.Phases {
+		for _, t := range phase.Transitions {
+			if t.Command == "" && t.Timeout <= 0 {
+				return fmt.Errorf("transition in phase '%s' has neither command nor timeout", phase.Name)
+			}
+			if t.Target != TargetNext && t.Target != TargetEnd && !names[t.Target] {
+				return fmt.Errorf("unknown target '%s' in phase '%s'", t.Target, phase.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// index returns the position of a phase by its name.
+func (p *Protocol) index(name string) (int, bool) {
+	for i, phase := range p.Phases {
+		if phase.Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// matches reports if a command name and payload trigger the transition.
+func (t *Transition) matches(command string, payload map[string]interface{}) bool {
+	if t.Command == "" || t.Command != command {
+		return false
+	}
+	for key, value := range t.Match {
+		if fmt.Sprint(payload[key]) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
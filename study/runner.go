@@ -0,0 +1,213 @@
+package study
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State describes the current position within a Protocol.
+type State struct {
+	Phase     string    `json:"phase"`
+	Trial     int       `json:"trial"`
+	Condition string    `json:"condition,omitempty"`
+	Since     time.Time `json:"since"`
+	Finished  bool      `json:"finished"`
+}
+
+// Runner executes a Protocol. Transitions are triggered by commands passed to Trigger, by explicit jumps through Goto
+// or by phase timeouts. Every state change is reported through OnTransition.
+type Runner struct {
+	OnTransition func(from State, to State, cause string)
+	protocol     *Protocol
+	mu           sync.Mutex
+	state        State
+	index        int
+	generation   uint64
+	timer        *time.Timer
+	conditions   []string
+}
+
+// NewRunner creates a new Runner for a Protocol. The Runner does not enter the first phase before Start is called.
+func NewRunner(p *Protocol) *Runner {
+	return &Runner{
+		protocol: p,
+		index:    -1,
+	}
+}
+
+// Protocol returns the executed protocol definition.
+func (r *Runner) Protocol() *Protocol {
+	return r.protocol
+}
+
+// State returns the current state.
+func (r *Runner) State() State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// SetConditions overrides the conditions of all phases defining conditions, e.g. with a counterbalanced sequence of
+// a participant. The override takes effect with the next trial.
+func (r *Runner) SetConditions(conditions []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conditions = conditions
+}
+
+// Start enters the first trial of the first phase. Calling Start again restarts the protocol.
+func (r *Runner) Start() {
+	r.mu.Lock()
+	from := r.state
+	r.enter(0, 1)
+	to := r.state
+	r.mu.Unlock()
+	r.notify(from, to, "start")
+}
+
+// Stop cancels pending timeouts. The current state is kept.
+func (r *Runner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.generation++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// Trigger evaluates the command-based transitions of the current phase and executes the first matching one. It
+// returns true if a transition took place.
+func (r *Runner) Trigger(command string, payload map[string]interface{}) bool {
+	r.mu.Lock()
+	if r.index < 0 || r.state.Finished {
+		r.mu.Unlock()
+		return false
+	}
+	for _, t := range r.protocol.Phases[r.index].Transitions {
+		if t.matches(command, payload) {
+			from := r.state
+			r.move(t.Target)
+			to := r.state
+			r.mu.Unlock()
+			r.notify(from, to, command)
+			return true
+		}
+	}
+	r.mu.Unlock()
+	return false
+}
+
+// Goto jumps to a target, which is either a phase name, TargetNext or TargetEnd. A finished protocol only changes
+// phases again after Start.
+func (r *Runner) Goto(target string, cause string) error {
+	r.mu.Lock()
+	if r.state.Finished {
+		r.mu.Unlock()
+		return fmt.Errorf("protocol '%s' is finished", r.protocol.Name)
+	}
+	if _, found := r.protocol.index(target); !found && target != TargetNext && target != TargetEnd {
+		r.mu.Unlock()
+		return fmt.Errorf("unknown phase '%s'", target)
+	}
+	from := r.state
+	r.move(target)
+	to := r.state
+	r.mu.Unlock()
+	r.notify(from, to, cause)
+	return nil
+}
+
+// move resolves a transition target and enters the resulting phase. The caller has to hold the lock.
+func (r *Runner) move(target string) {
+	switch target {
+	case TargetEnd:
+		r.finish()
+	case TargetNext:
+		if r.index < 0 {
+			r.enter(0, 1)
+		} else if r.state.Trial < r.protocol.Phases[r.index].Trials {
+			r.enter(r.index, r.state.Trial+1)
+		} else if r.index+1 < len(r.protocol.Phases) {
+			r.enter(r.index+1, 1)
+		} else {
+			r.finish()
+		}
+	default:
+		i, _ := r.protocol.index(target)
+		r.enter(i, 1)
+	}
+}
+
+// enter sets the state to a trial of a phase and arms its timeout. The caller has to hold the lock.
+func (r *Runner) enter(index int, trial int) {
+	phase := r.protocol.Phases[index]
+	r.index = index
+	r.state = State{
+		Phase:     phase.Name,
+		Trial:     trial,
+		Condition: r.condition(index, trial),
+		Since:     time.Now(),
+	}
+	r.arm(phase)
+}
+
+// finish marks the protocol as completed. The caller has to hold the lock.
+func (r *Runner) finish() {
+	r.state.Finished = true
+	r.state.Since = time.Now()
+	r.arm(Phase{})
+}
+
+// condition returns the condition of a trial. Conditions are cycled if there are more trials than conditions.
+func (r *Runner) condition(index int, trial int) string {
+	conditions := r.protocol.Phases[index].Conditions
+	if len(conditions) == 0 {
+		return ""
+	}
+	if len(r.conditions) > 0 {
+		conditions = r.conditions
+	}
+	return conditions[(trial-1)%len(conditions)]
+}
+
+// arm replaces the pending timer with the shortest timeout transition of a phase. The caller has to hold the lock.
+func (r *Runner) arm(phase Phase) {
+	r.generation++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	var next *Transition
+	for i, t := range phase.Transitions {
+		if t.Timeout > 0 && (next == nil || t.Timeout < next.Timeout) {
+			next = &phase.Transitions[i]
+		}
+	}
+	if next == nil {
+		return
+	}
+	generation := r.generation
+	target := next.Target
+	r.timer = time.AfterFunc(time.Duration(next.Timeout), func() {
+		r.mu.Lock()
+		if generation != r.generation {
+			// Another transition happened in the meantime
+			r.mu.Unlock()
+			return
+		}
+		from := r.state
+		r.move(target)
+		to := r.state
+		r.mu.Unlock()
+		r.notify(from, to, "timeout")
+	})
+}
+
+// notify calls OnTransition, if set.
+func (r *Runner) notify(from State, to State, cause string) {
+	if r.OnTransition != nil {
+		r.OnTransition(from, to, cause)
+	}
+}
@@ -0,0 +1,148 @@
+package study
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProtocol has a baseline left by command, two trials with conditions and a rest phase ending by timeout.
+func testProtocol() *Protocol {
+	return &Protocol{
+		Name: "test",
+		Phases: []Phase{
+			{Name: "baseline", Transitions: []Transition{
+				{Command: "msg", Match: map[string]interface{}{"event": "skip"}, Target: TargetNext},
+			}},
+			{Name: "trials", Trials: 2, Conditions: []string{"A", "B"}, Transitions: []Transition{
+				{Command: "msg", Match: map[string]interface{}{"event": "trial_done"}, Target: TargetNext},
+			}},
+			{Name: "rest", Transitions: []Transition{
+				{Timeout: Duration(20 * time.Millisecond), Target: TargetEnd},
+			}},
+		},
+	}
+}
+
+// recorder collects the transitions of a Runner as "from -> to (cause)".
+type recorder struct {
+	mu          sync.Mutex
+	transitions []string
+}
+
+func (rec *recorder) observe(from State, to State, cause string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.transitions = append(rec.transitions, fmt.Sprintf("%s -> %s (%s)", describe(from), describe(to), cause))
+}
+
+func (rec *recorder) list() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.transitions...)
+}
+
+// describe formats a State as phase, trial and condition.
+func describe(s State) string {
+	switch {
+	case s.Finished:
+		return "finished"
+	case s.Phase == "":
+		return "idle"
+	}
+	return fmt.Sprintf("%s/%d%s", s.Phase, s.Trial, s.Condition)
+}
+
+func TestTransitionOrder(t *testing.T) {
+	r := NewRunner(testProtocol())
+	rec := &recorder{}
+	r.OnTransition = rec.observe
+	r.Start()
+	steps := []struct {
+		command   string
+		event     string
+		triggered bool
+	}{
+		{"msg", "trial_done", false},
+		{"set", "skip", false},
+		{"msg", "skip", true},
+		{"msg", "skip", false},
+		{"msg", "trial_done", true},
+		{"msg", "trial_done", true},
+	}
+	for _, step := range steps {
+		if r.Trigger(step.command, map[string]interface{}{"event": step.event}) != step.triggered {
+			t.Errorf("%s %s: expected triggered to be %v", step.command, step.event, step.triggered)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); !r.State().Finished; {
+		if time.Now().After(deadline) {
+			t.Fatal("rest phase did not time out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expected := []string{
+		"idle -> baseline/1 (start)",
+		"baseline/1 -> trials/1A (msg)",
+		"trials/1A -> trials/2B (msg)",
+		"trials/2B -> rest/1 (msg)",
+		"rest/1 -> finished (timeout)",
+	}
+	if got := rec.list(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestSetConditions(t *testing.T) {
+	r := NewRunner(testProtocol())
+	r.SetConditions([]string{"B", "A"})
+	r.Start()
+	if err := r.Goto("trials", "phase"); err != nil {
+		t.Fatal(err)
+	}
+	for _, condition := range []string{"B", "A"} {
+		if s := r.State(); s.Condition != condition {
+			t.Errorf("trial %d: expected condition %s, got %s", s.Trial, condition, s.Condition)
+		}
+		if err := r.Goto(TargetNext, "phase"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Stop()
+}
+
+func TestRejectAfterFinished(t *testing.T) {
+	r := NewRunner(testProtocol())
+	rec := &recorder{}
+	r.OnTransition = rec.observe
+	r.Start()
+	if err := r.Goto("unknown", "phase"); err == nil {
+		t.Error("jumped to an unknown phase")
+	}
+	if err := r.Goto(TargetEnd, "phase"); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"baseline", TargetNext, TargetEnd} {
+		if err := r.Goto(target, "phase"); err == nil || err.Error() != "protocol 'test' is finished" {
+			t.Errorf("%s: got error %v", target, err)
+		}
+	}
+	if r.Trigger("msg", map[string]interface{}{"event": "skip"}) {
+		t.Error("finished protocol was triggered")
+	}
+	r.Start()
+	if s := r.State(); s.Finished || s.Phase != "baseline" {
+		t.Errorf("restart: got state %+v", s)
+	}
+	r.Stop()
+	expected := []string{
+		"idle -> baseline/1 (start)",
+		"baseline/1 -> finished (phase)",
+		"finished -> baseline/1 (start)",
+	}
+	if got := rec.list(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
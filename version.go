@@ -0,0 +1,4 @@
+package main
+
+// Version of the broker. Release builds set it with -ldflags "-X main.Version=<version>".
+var Version = "dev"